@@ -22,6 +22,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
 )
@@ -40,21 +41,85 @@ type Bitmap struct {
 	// memMoved keeps track of how many uint16 moves we had to do. The smaller
 	// this number, the more efficient we have been.
 	memMoved int
+
+	// rankIdx is built lazily by Rank and Select, and dropped on every modification.
+	rankIdx atomic.Pointer[rankIndex]
+
+	// readOnly bitmaps panic with ErrReadOnly on every modification.
+	readOnly bool
+	// copyOnWrite bitmaps copy the buffer they are based on before the first modification.
+	copyOnWrite bool
+	// mapping is the memory mapped file backing the bitmap, unmapped by Close.
+	mapping []byte
+}
+
+// ErrReadOnly is the value of the panic raised when a read-only bitmap is modified.
+var ErrReadOnly = errors.New("bitmap is read-only")
+
+// IsReadOnly returns true if the bitmap can not be modified. Bitmaps created by FromBuffer and
+// OpenMapped are read-only, until MakeWritable or Thaw is called.
+func (ra *Bitmap) IsReadOnly() bool {
+	return ra != nil && ra.readOnly
+}
+
+// MakeWritable copies the buffer of a read-only bitmap, so the bitmap can be modified without
+// affecting the buffer. It is a no-op for writable bitmaps.
+func (ra *Bitmap) MakeWritable() {
+	if ra.readOnly || ra.copyOnWrite {
+		ra.copyData()
+	}
+	ra.readOnly = false
+}
+
+// Thaw makes a read-only bitmap writable. Unlike MakeWritable, the buffer is copied lazily,
+// on the first modification of the bitmap.
+func (ra *Bitmap) Thaw() {
+	if ra.readOnly {
+		ra.readOnly = false
+		ra.copyOnWrite = true
+	}
 }
 
-// FromBuffer returns a pointer to bitmap corresponding to the given buffer. This bitmap shouldn't
-// be modified because it might corrupt the given buffer.
+// copyData replaces the buffer of the bitmap with its copy owned by the bitmap.
+func (ra *Bitmap) copyData() {
+	data := make([]uint16, len(ra.data))
+	copy(data, ra.data)
+	ra.data = data
+	ra.keys = toUint64Slice(data[:ra.keys.size()])
+	ra._ptr = nil
+	ra.copyOnWrite = false
+}
+
+// prepareWrite has to be called by every method modifying the bitmap. It panics if the bitmap
+// is read-only, copies the buffer of thawed bitmaps and drops the rank index.
+func (ra *Bitmap) prepareWrite() {
+	if ra.readOnly {
+		panic(ErrReadOnly)
+	}
+	if ra.copyOnWrite {
+		ra.copyData()
+	}
+	ra.invalidateRankIndex()
+}
+
+// FromBuffer returns a pointer to bitmap corresponding to the given buffer. The bitmap is
+// read-only, as modifying it would corrupt the given buffer. Modifications panic with ErrReadOnly,
+// unless MakeWritable or Thaw is called first. The buffer is not validated, use FromBufferSafe
+// for buffers which can not be trusted.
 func FromBuffer(data []byte) *Bitmap {
 	assert(len(data)%2 == 0)
 	if len(data) < 8 {
-		return NewBitmap()
+		bm := NewBitmap()
+		bm.readOnly = true
+		return bm
 	}
 	du := byteTo16SliceUnsafe(data)
 	x := toUint64Slice(du[:4])[indexNodeSize]
 	return &Bitmap{
-		data: du,
-		_ptr: data, // Keep a hold of data, otherwise GC would do its thing.
-		keys: toUint64Slice(du[:x]),
+		data:     du,
+		_ptr:     data, // Keep a hold of data, otherwise GC would do its thing.
+		keys:     toUint64Slice(du[:x]),
+		readOnly: true,
 	}
 }
 
@@ -76,6 +141,139 @@ func FromBufferWithCopy(src []byte) *Bitmap {
 	}
 }
 
+// ErrInvalidBuffer is returned by Validate and FromBufferSafe for buffers not holding
+// a valid bitmap.
+var ErrInvalidBuffer = errors.New("invalid bitmap buffer")
+
+// FromBufferSafe validates the given buffer and returns a pointer to bitmap corresponding to it.
+// Just like with FromBuffer, the bitmap is read-only. Use it instead of FromBuffer for
+// buffers which can not be trusted, e.g. read from disk.
+func FromBufferSafe(data []byte) (*Bitmap, error) {
+	if err := Validate(data); err != nil {
+		return nil, err
+	}
+	return FromBuffer(data), nil
+}
+
+// Validate checks whether the buffer holds a valid bitmap, so it can be safely passed to
+// FromBuffer, FromBufferWithCopy or FromBufferUnlimited. It verifies the keys node, ordering of
+// the keys, bounds of the containers, their types, sizes and cardinalities. Returned error
+// wraps ErrInvalidBuffer.
+func Validate(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if len(data)%2 != 0 {
+		return errors.Wrapf(ErrInvalidBuffer, "odd buffer length %d", len(data))
+	}
+	du := byteTo16SliceUnsafe(data)
+	if len(du) < 4 {
+		return errors.Wrapf(ErrInvalidBuffer, "buffer length %d too short", len(data))
+	}
+
+	// Keys node has to fit at least the key = 0 and space for one more key.
+	sz := toUint64Slice(du[:4])[indexNodeSize]
+	if sz < uint64(calcInitialKeysLen(2)) || sz%4 != 0 || sz > uint64(len(du)) {
+		return errors.Wrapf(ErrInvalidBuffer, "invalid keys node size %d for buffer of %d uint16s",
+			sz, len(du))
+	}
+	keys := node(toUint64Slice(du[:sz]))
+	n := keys.numKeys()
+	if n < 1 || n >= keys.maxKeys() {
+		return errors.Wrapf(ErrInvalidBuffer, "invalid number of keys %d, keys node fits %d",
+			n, keys.maxKeys())
+	}
+	if keys.key(0) != 0 {
+		return errors.Wrapf(ErrInvalidBuffer, "first key %#x is not 0", keys.key(0))
+	}
+
+	type span struct{ start, end uint64 }
+	spans := make([]span, 0, n)
+	for i := 0; i < n; i++ {
+		key := keys.key(i)
+		if key&^mask != 0 {
+			return errors.Wrapf(ErrInvalidBuffer, "key %#x has lower bits set", key)
+		}
+		if i > 0 && key <= keys.key(i-1) {
+			return errors.Wrapf(ErrInvalidBuffer, "key %#x is not greater than previous key %#x",
+				key, keys.key(i-1))
+		}
+		off := keys.val(i)
+		if off < sz || off > uint64(len(du))-uint64(startIdx) {
+			return errors.Wrapf(ErrInvalidBuffer, "offset %d of key %#x out of bounds", off, key)
+		}
+		size := uint64(du[off+uint64(indexSize)])
+		if size < uint64(startIdx) || off+size > uint64(len(du)) {
+			return errors.Wrapf(ErrInvalidBuffer, "size %d of container at offset %d out of bounds",
+				size, off)
+		}
+		if err := validateContainer(du[off : off+size]); err != nil {
+			return errors.Wrapf(err, "container of key %#x at offset %d", key, off)
+		}
+		spans = append(spans, span{off, off + size})
+	}
+
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	for i := 1; i < len(spans); i++ {
+		if spans[i].start < spans[i-1].end {
+			return errors.Wrapf(ErrInvalidBuffer, "containers at offsets %d and %d overlap",
+				spans[i-1].start, spans[i].start)
+		}
+	}
+	return nil
+}
+
+func validateContainer(c []uint16) error {
+	card := getCardinality(c)
+	if card > maxCardinality {
+		return errors.Wrapf(ErrInvalidBuffer, "cardinality %d is too high", card)
+	}
+
+	switch c[indexType] {
+	case typeArray:
+		if card > len(c)-int(startIdx) {
+			return errors.Wrapf(ErrInvalidBuffer, "cardinality %d exceeds array size %d",
+				card, len(c))
+		}
+		vals := c[startIdx : int(startIdx)+card]
+		for i := 1; i < len(vals); i++ {
+			if vals[i] <= vals[i-1] {
+				return errors.Wrapf(ErrInvalidBuffer, "array elements %d and %d are not sorted",
+					vals[i-1], vals[i])
+			}
+		}
+	case typeBitmap:
+		if len(c) != maxContainerSize {
+			return errors.Wrapf(ErrInvalidBuffer, "invalid bitmap size %d", len(c))
+		}
+		if actual := bitmap(c).cardinality(); actual != card {
+			return errors.Wrapf(ErrInvalidBuffer, "bitmap cardinality %d, expected %d",
+				card, actual)
+		}
+	case typeRun:
+		r := run(c)
+		if len(c) <= int(indexNumRuns) || runSize(r.numRuns()) > len(c) {
+			return errors.Wrapf(ErrInvalidBuffer, "run size %d too small", len(c))
+		}
+		var actual int
+		for i := 0; i < r.numRuns(); i++ {
+			start, last := r.start(i), r.last(i)
+			// Runs have to be sorted and not adjacent.
+			if start > last || (i > 0 && int(start) <= int(r.last(i-1))+1) {
+				return errors.Wrapf(ErrInvalidBuffer, "run [%d, %d] is not sorted", start, last)
+			}
+			actual += int(last-start) + 1
+		}
+		if actual != card {
+			return errors.Wrapf(ErrInvalidBuffer, "run cardinality %d, expected %d",
+				card, actual)
+		}
+	default:
+		return errors.Wrapf(ErrInvalidBuffer, "unknown container type %d", c[indexType])
+	}
+	return nil
+}
+
 func (ra *Bitmap) ToBuffer() []byte {
 	if ra.IsEmpty() {
 		return nil
@@ -277,8 +475,15 @@ func (ra *Bitmap) expandContainer(offset uint64) {
 
 	} else {
 		// Convert to bitmap container.
-		src := array(ra.getContainer(offset))
-		buf := src.toBitmapContainer(nil)
+		var buf []uint16
+		switch c := ra.getContainer(offset); c[indexType] {
+		case typeArray:
+			buf = array(c).toBitmapContainer(nil)
+		case typeRun:
+			buf = run(c).toBitmapContainer(nil)
+		default:
+			panic("Only array and run containers can be expanded")
+		}
 		assert(copy(ra.data[offset:], buf) == maxContainerSize)
 	}
 }
@@ -391,7 +596,10 @@ func (ra *Bitmap) Clone() *Bitmap {
 	abuf := ra.ToBuffer()
 	bbuf := make([]byte, len(abuf))
 	copy(bbuf, abuf)
-	return FromBuffer(bbuf)
+	bm := FromBuffer(bbuf)
+	// The copied buffer is owned by the clone.
+	bm.readOnly = false
+	return bm
 }
 
 func (ra *Bitmap) IsEmpty() bool {
@@ -410,6 +618,7 @@ func (ra *Bitmap) IsEmpty() bool {
 }
 
 func (ra *Bitmap) Set(x uint64) bool {
+	ra.prepareWrite()
 	key := x & mask
 	offset, has := ra.keys.getValue(key)
 	if !has {
@@ -419,9 +628,9 @@ func (ra *Bitmap) Set(x uint64) bool {
 		offset = ra.setKey(key, o)
 	}
 
-	// make sure there is enough space to put new value in array container
+	// make sure there is enough space to put new value in array or run container
 	c := ra.getContainer(offset)
-	if c[indexType] == typeArray && array(c).isFull() {
+	if isFullContainer(c) {
 		ra.expandContainer(offset)
 
 		// not sure if needed after expanding,
@@ -444,10 +653,25 @@ func (ra *Bitmap) Set(x uint64) bool {
 	case typeBitmap:
 		b := bitmap(c)
 		return b.add(uint16(x))
+	case typeRun:
+		r := run(c)
+		return r.add(uint16(x))
 	}
 	panic("we shouldn't reach here")
 }
 
+// isFullContainer returns true if there might not be enough space in the container to add another
+// value, or in case of run container, to split one of its runs.
+func isFullContainer(c []uint16) bool {
+	switch c[indexType] {
+	case typeArray:
+		return array(c).isFull()
+	case typeRun:
+		return run(c).isFull()
+	}
+	return false
+}
+
 func FromSortedList(vals []uint64) *Bitmap {
 	var arr []uint16
 	var hi, lastHi, off uint64
@@ -523,28 +747,20 @@ func (ra *Bitmap) SetMany(vals []uint64) {
 
 // Select returns the element at the xth index. (0-indexed)
 func (ra *Bitmap) Select(x uint64) (uint64, error) {
-	if x >= uint64(ra.GetCardinality()) {
-		return 0, errors.Errorf("index %d is not less than the cardinality: %d",
-			x, ra.GetCardinality())
-	}
-	n := ra.keys.numKeys()
-	for i := 0; i < n; i++ {
-		off := ra.keys.val(i)
-		con := ra.getContainer(off)
-		c := uint64(getCardinality(con))
-		assert(c != uint64(invalidCardinality))
-		if x < c {
-			key := ra.keys.key(i)
-			switch con[indexType] {
-			case typeArray:
-				return key | uint64(array(con).all()[x]), nil
-			case typeBitmap:
-				return key | uint64(bitmap(con).selectAt(int(x))), nil
-			}
+	return ra.rankIndex().selectAt(ra, x)
+}
+
+// SelectMany returns the elements at the given indexes. (0-indexed)
+func (ra *Bitmap) SelectMany(indexes []uint64) ([]uint64, error) {
+	idx := ra.rankIndex()
+	res := make([]uint64, len(indexes))
+	for i, x := range indexes {
+		var err error
+		if res[i], err = idx.selectAt(ra, x); err != nil {
+			return nil, err
 		}
-		x -= c
 	}
-	panic("should not reach here")
+	return res, nil
 }
 
 func (ra *Bitmap) Contains(x uint64) bool {
@@ -566,6 +782,9 @@ func (ra *Bitmap) Contains(x uint64) bool {
 	case typeBitmap:
 		b := bitmap(c)
 		return b.has(y)
+	case typeRun:
+		r := run(c)
+		return r.has(y)
 	}
 	return false
 }
@@ -574,6 +793,7 @@ func (ra *Bitmap) Remove(x uint64) bool {
 	if ra == nil {
 		return false
 	}
+	ra.prepareWrite()
 	key := x & mask
 	offset, has := ra.keys.getValue(key)
 	if !has {
@@ -587,12 +807,24 @@ func (ra *Bitmap) Remove(x uint64) bool {
 	case typeBitmap:
 		b := bitmap(c)
 		return b.remove(uint16(x))
+	case typeRun:
+		r := run(c)
+		if !r.has(uint16(x)) {
+			return false
+		}
+		if r.isFull() {
+			// Removing x might split a run in two. Make space for it first.
+			ra.expandContainer(offset)
+			return ra.Remove(x)
+		}
+		return r.remove(uint16(x))
 	}
 	return true
 }
 
 // Remove range removes [lo, hi) from the bitmap.
 func (ra *Bitmap) RemoveRange(lo, hi uint64) {
+	ra.prepareWrite()
 	if lo > hi {
 		panic("lo should not be more than hi")
 	}
@@ -608,8 +840,7 @@ func (ra *Bitmap) RemoveRange(lo, hi uint64) {
 	//  Complete range lie in a single container
 	if k1 == k2 {
 		if off, has := ra.keys.getValue(k1); has {
-			c := ra.getContainer(off)
-			removeRangeContainer(c, uint16(lo), uint16(hi)-1)
+			ra.removeRangeAt(off, uint16(lo), uint16(hi)-1)
 		}
 		return
 	}
@@ -634,11 +865,10 @@ func (ra *Bitmap) RemoveRange(lo, hi uint64) {
 
 	// Remove elements >= lo in k1's container
 	if off, has := ra.keys.getValue(k1); has {
-		c := ra.getContainer(off)
 		if uint16(lo) == 0 {
-			zeroOutContainer(c)
+			zeroOutContainer(ra.getContainer(off))
 		} else {
-			removeRangeContainer(c, uint16(lo), math.MaxUint16)
+			ra.removeRangeAt(off, uint16(lo), math.MaxUint16)
 		}
 	}
 
@@ -648,12 +878,23 @@ func (ra *Bitmap) RemoveRange(lo, hi uint64) {
 
 	// Remove all elements < hi in k2's container
 	if off, has := ra.keys.getValue(k2); has {
-		c := ra.getContainer(off)
-		removeRangeContainer(c, 0, uint16(hi)-1)
+		ra.removeRangeAt(off, 0, uint16(hi)-1)
 	}
 }
 
+// removeRangeAt removes [lo, hi] from the container at the given offset.
+func (ra *Bitmap) removeRangeAt(offset uint64, lo, hi uint16) {
+	c := ra.getContainer(offset)
+	if c[indexType] == typeRun && run(c).isFull() {
+		// Removing a range from the middle of a run splits it in two. Make space for it.
+		ra.expandContainer(offset)
+		c = ra.getContainer(offset)
+	}
+	removeRangeContainer(c, lo, hi)
+}
+
 func (ra *Bitmap) Reset() {
+	ra.prepareWrite()
 	keysLen := calcInitialKeysLen(2)
 	ra.data = ra.data[:keysLen]
 	ra.keys = toUint64Slice(ra.data)
@@ -668,6 +909,7 @@ func (ra *Bitmap) Reset() {
 }
 
 func (ra *Bitmap) ZeroOut() {
+	ra.prepareWrite()
 	for i := 0; i < ra.keys.numKeys(); i++ {
 		off := ra.keys.val(i)
 		c := ra.getContainer(off)
@@ -712,11 +954,32 @@ func (ra *Bitmap) ToArray() []uint64 {
 			for _, x := range out {
 				res = append(res, key|uint64(x))
 			}
+		case typeRun:
+			r := run(c)
+			for i := 0; i < r.numRuns(); i++ {
+				for x := uint64(r.start(i)); x <= uint64(r.last(i)); x++ {
+					res = append(res, key|x)
+				}
+			}
 		}
 	}
 	return res
 }
 
+// ToArrayRange returns the elements in the range [lo, hi) in ascending order.
+func (ra *Bitmap) ToArrayRange(lo, hi uint64) []uint64 {
+	if ra == nil || lo >= hi {
+		return nil
+	}
+	var res []uint64
+	it := ra.NewIterator()
+	it.Seek(lo)
+	for x, ok := it.advance(); ok && x < hi; x, ok = it.advance() {
+		res = append(res, x)
+	}
+	return res
+}
+
 func (ra *Bitmap) String() string {
 	var b strings.Builder
 	b.WriteRune('\n')
@@ -753,8 +1016,25 @@ func (ra *Bitmap) String() string {
 const fwd int = 0x01
 const rev int = 0x02
 
-func (ra *Bitmap) Minimum() uint64 { return ra.extreme(fwd) }
-func (ra *Bitmap) Maximum() uint64 { return ra.extreme(rev) }
+// Minimum returns the smallest element of the bitmap, 0 if the bitmap is empty.
+// Use MinimumOK to tell an empty bitmap apart from a bitmap containing 0.
+func (ra *Bitmap) Minimum() uint64 {
+	x, _ := ra.extreme(fwd)
+	return x
+}
+
+// Maximum returns the largest element of the bitmap, 0 if the bitmap is empty.
+// Use MaximumOK to tell an empty bitmap apart from a bitmap containing only 0.
+func (ra *Bitmap) Maximum() uint64 {
+	x, _ := ra.extreme(rev)
+	return x
+}
+
+// MinimumOK returns the smallest element of the bitmap, and false if the bitmap is empty.
+func (ra *Bitmap) MinimumOK() (uint64, bool) { return ra.extreme(fwd) }
+
+// MaximumOK returns the largest element of the bitmap, and false if the bitmap is empty.
+func (ra *Bitmap) MaximumOK() (uint64, bool) { return ra.extreme(rev) }
 
 func (ra *Bitmap) Debug(x uint64) string {
 	var b strings.Builder
@@ -775,58 +1055,84 @@ func (ra *Bitmap) Debug(x uint64) string {
 		idx := lo / 16
 		pos := lo % 16
 		b.WriteString(fmt.Sprintf("At idx: %d. Pos: %d val: %#b\n", idx, pos, c[startIdx+idx]))
+	case typeRun:
+		r := run(c)
+		if i := r.find(lo); i < r.numRuns() {
+			b.WriteString(fmt.Sprintf("At run: %d. Run: [%d, %d]\n", i, r.start(i), r.last(i)))
+		}
 	}
 	return b.String()
 }
 
-func (ra *Bitmap) extreme(dir int) uint64 {
-	N := ra.keys.numKeys()
-	if N == 0 {
-		return 0
+// extreme returns the minimum or the maximum element of the bitmap, and false if the bitmap
+// is empty.
+func (ra *Bitmap) extreme(dir int) (uint64, bool) {
+	if ra == nil {
+		return 0, false
 	}
-
-	var k uint64
-	var c []uint16
-
+	N := ra.keys.numKeys()
 	if dir == fwd {
 		for i := 0; i < N; i++ {
-			offset := ra.keys.val(i)
-			c = ra.getContainer(offset)
-			if getCardinality(c) > 0 {
-				k = ra.keys.key(i)
-				break
+			if c := ra.getContainer(ra.keys.val(i)); getCardinality(c) > 0 {
+				return ra.keys.key(i) | uint64(minimum(c)), true
 			}
 		}
 	} else {
 		for i := N - 1; i >= 0; i-- {
-			offset := ra.keys.val(i)
-			c = ra.getContainer(offset)
-			if getCardinality(c) > 0 {
-				k = ra.keys.key(i)
-				break
+			if c := ra.getContainer(ra.keys.val(i)); getCardinality(c) > 0 {
+				return ra.keys.key(i) | uint64(maximum(c)), true
 			}
 		}
 	}
+	return 0, false
+}
 
-	switch c[indexType] {
-	case typeArray:
-		a := array(c)
-		if dir == fwd {
-			return k | uint64(a.minimum())
+// NextValue returns the smallest element >= x, and false if there is no such element.
+func (ra *Bitmap) NextValue(x uint64) (uint64, bool) {
+	if ra == nil {
+		return 0, false
+	}
+	key := x & mask
+	N := ra.keys.numKeys()
+	for i := ra.keys.search(key); i < N; i++ {
+		c := ra.getContainer(ra.keys.val(i))
+		if getCardinality(c) == 0 {
+			continue
 		}
-		return k | uint64(a.maximum())
-	case typeBitmap:
-		b := bitmap(c)
-		if dir == fwd {
-			return k | uint64(b.minimum())
+		k := ra.keys.key(i)
+		if k > key {
+			return k | uint64(minimum(c)), true
+		}
+		if y, ok := nextValue(c, uint16(x)); ok {
+			return k | uint64(y), true
+		}
+	}
+	return 0, false
+}
+
+// PreviousValue returns the largest element <= x, and false if there is no such element.
+func (ra *Bitmap) PreviousValue(x uint64) (uint64, bool) {
+	if ra == nil {
+		return 0, false
+	}
+	key := x & mask
+	i := ra.keys.search(key)
+	if i < ra.keys.numKeys() && ra.keys.key(i) == key {
+		c := ra.getContainer(ra.keys.val(i))
+		if y, ok := previousValue(c, uint16(x)); ok {
+			return key | uint64(y), true
+		}
+	}
+	for i--; i >= 0; i-- {
+		if c := ra.getContainer(ra.keys.val(i)); getCardinality(c) > 0 {
+			return ra.keys.key(i) | uint64(maximum(c)), true
 		}
-		return k | uint64(b.maximum())
-	default:
-		panic("We don't support this type of container")
 	}
+	return 0, false
 }
 
 func (ra *Bitmap) AndOld(bm *Bitmap) {
+	ra.prepareWrite()
 	if bm == nil {
 		ra.Reset()
 		return
@@ -905,6 +1211,7 @@ func AndOld(a, b *Bitmap) *Bitmap {
 }
 
 func (ra *Bitmap) AndNotOld(bm *Bitmap) {
+	ra.prepareWrite()
 	if bm == nil {
 		return
 	}
@@ -943,6 +1250,7 @@ func (ra *Bitmap) AndNotOld(bm *Bitmap) {
 
 // TODO: Check if we want to use lazyMode
 func (dst *Bitmap) OrOld(src *Bitmap) {
+	dst.prepareWrite()
 	if src == nil {
 		return
 	}
@@ -1035,11 +1343,11 @@ func OrOld(a, b *Bitmap) *Bitmap {
 
 func (ra *Bitmap) Rank(x uint64) int {
 	key := x & mask
-	offset, has := ra.keys.getValue(key)
-	if !has {
+	i := ra.keys.search(key)
+	if i >= ra.keys.numKeys() || ra.keys.key(i) != key {
 		return -1
 	}
-	c := ra.getContainer(offset)
+	c := ra.getContainer(ra.keys.val(i))
 	y := uint16(x)
 
 	// Find the rank within the container
@@ -1049,24 +1357,102 @@ func (ra *Bitmap) Rank(x uint64) int {
 		rank = array(c).rank(y)
 	case typeBitmap:
 		rank = bitmap(c).rank(y)
+	case typeRun:
+		rank = run(c).rank(y)
 	}
 	if rank < 0 {
 		return -1
 	}
 
 	// Add up cardinalities of all the containers on the left of container containing x.
+	return ra.rankIndex().cum[i] + rank
+}
+
+// rankIndex keeps the cumulative cardinalities of the containers, so Rank and Select do not
+// need to sum up cardinalities of all the preceding containers.
+type rankIndex struct {
+	// cum[i] is the number of elements in the containers [0, i). It has numKeys+1 entries.
+	cum []int
+}
+
+// rankIndex returns the rank index of the bitmap, building it if needed.
+func (ra *Bitmap) rankIndex() *rankIndex {
+	if idx := ra.rankIdx.Load(); idx != nil {
+		return idx
+	}
 	n := ra.keys.numKeys()
+	idx := &rankIndex{cum: make([]int, n+1)}
 	for i := 0; i < n; i++ {
-		if ra.keys.key(i) == key {
+		idx.cum[i+1] = idx.cum[i] + getCardinality(ra.getContainer(ra.keys.val(i)))
+	}
+	ra.rankIdx.Store(idx)
+	return idx
+}
+
+// invalidateRankIndex drops the rank index.
+func (ra *Bitmap) invalidateRankIndex() {
+	if ra.rankIdx.Load() != nil {
+		ra.rankIdx.Store(nil)
+	}
+}
+
+func (idx *rankIndex) selectAt(ra *Bitmap, x uint64) (uint64, error) {
+	n := len(idx.cum) - 1
+	if x >= uint64(idx.cum[n]) {
+		return 0, errors.Errorf("index %d is not less than the cardinality: %d",
+			x, idx.cum[n])
+	}
+	// Find the container i, such that cum[i] <= x < cum[i+1].
+	i := sort.Search(n, func(i int) bool { return uint64(idx.cum[i+1]) > x })
+	con := ra.getContainer(ra.keys.val(i))
+	key := ra.keys.key(i)
+	y := int(x) - idx.cum[i]
+	switch con[indexType] {
+	case typeArray:
+		return key | uint64(con[int(startIdx)+y]), nil
+	case typeBitmap:
+		return key | uint64(bitmap(con).selectAt(y)), nil
+	case typeRun:
+		return key | uint64(run(con).selectAt(y)), nil
+	}
+	panic("should not reach here")
+}
+
+// CountRange returns the number of elements in the range [lo, hi). Cardinalities of the
+// containers fully covered by the range are taken from their headers, only the containers on
+// the edges of the range are counted.
+func (ra *Bitmap) CountRange(lo, hi uint64) int {
+	if ra == nil || lo >= hi {
+		return 0
+	}
+	last := hi - 1
+	k1, k2 := lo&mask, last&mask
+
+	var count int
+	n := ra.keys.numKeys()
+	for i := ra.keys.search(k1); i < n; i++ {
+		key := ra.keys.key(i)
+		if key < k1 {
+			continue
+		}
+		if key > k2 {
 			break
 		}
-		cont := ra.getContainer(ra.keys.val(i))
-		rank += getCardinality(cont)
+		c := ra.getContainer(ra.keys.val(i))
+		start, end := uint16(0), uint16(math.MaxUint16)
+		if key == k1 {
+			start = uint16(lo)
+		}
+		if key == k2 {
+			end = uint16(last)
+		}
+		count += rangeCardinality(c, start, end)
 	}
-	return rank
+	return count
 }
 
 func (ra *Bitmap) Cleanup() {
+	ra.prepareWrite()
 	type interval struct {
 		start uint64
 		end   uint64
@@ -1277,7 +1663,8 @@ func (bm *Bitmap) Split(externalSize func(start, end uint64) uint64, maxSz uint6
 		newBm := NewBitmap()
 		var sz uint64
 		var bms []*Bitmap
-		for id := itr.Next(); id != 0; id = itr.Next() {
+		for itr.HasNext() {
+			id := itr.Next()
 			sz += externalSize(id, id)
 			newBm.Set(id)
 			if sz >= maxSz {
@@ -45,12 +45,14 @@ func andContainers(a, b, res *Bitmap, optBuf []uint16) {
 }
 
 func (ra *Bitmap) And(bm *Bitmap) *Bitmap {
+	ra.prepareWrite()
 	if bm.IsEmpty() {
 		ra.ZeroOut()
 		return ra
 	}
 
-	andContainersInRange(ra, bm, 0, ra.keys.numKeys(), nil)
+	keys, containers := andContainersInRange(ra, bm, 0, ra.keys.numKeys(), nil)
+	ra.replaceContainers(keys, containers)
 	return ra
 }
 
@@ -65,6 +67,7 @@ func (ra *Bitmap) And(bm *Bitmap) *Bitmap {
 // - maxConcurrency = 2, there will be 2 goroutines executed
 // - maxConcurrency = 6, there will be 4 goroutines executed
 func (ra *Bitmap) AndConc(bm *Bitmap, maxConcurrency int) *Bitmap {
+	ra.prepareWrite()
 	if bm.IsEmpty() {
 		ra.ZeroOut()
 		return ra
@@ -72,12 +75,22 @@ func (ra *Bitmap) AndConc(bm *Bitmap, maxConcurrency int) *Bitmap {
 
 	numContainers := ra.keys.numKeys()
 	concurrency := calcConcurrency(numContainers, minContainersPerRoutine, maxConcurrency)
-	callback := func(ai, aj, _ int) { andContainersInRange(ra, bm, ai, aj, nil) }
+	allKeys := make([][]uint64, concurrency)
+	allContainers := make([][][]uint16, concurrency)
+	callback := func(ai, aj, i int) {
+		allKeys[i], allContainers[i] = andContainersInRange(ra, bm, ai, aj, nil)
+	}
 	concurrentlyInRanges(numContainers, concurrency, callback)
+	for i := range allKeys {
+		ra.replaceContainers(allKeys[i], allContainers[i])
+	}
 	return ra
 }
 
-func andContainersInRange(a, b *Bitmap, ai, aj int, optBuf []uint16) {
+// andContainersInRange merges containers inline. Only run containers might not fit the result
+// of merge, such containers are copied and returned with their keys, to be placed by the caller.
+func andContainersInRange(a, b *Bitmap, ai, aj int, optBuf []uint16,
+) (aKeys []uint64, aContainers [][]uint16) {
 	ak := a.keys.key(ai)
 	bi := b.keys.search(ak)
 	bn := b.keys.numKeys()
@@ -91,7 +104,10 @@ func andContainersInRange(a, b *Bitmap, ai, aj int, optBuf []uint16) {
 			off = b.keys.val(bi)
 			bc := b.getContainer(off)
 			if c := containerAndAlt(ac, bc, optBuf, runInline); len(c) > 0 {
-				panic("new container not expected in And inline mode")
+				cc := make([]uint16, len(c))
+				copy(cc, c)
+				aKeys = append(aKeys, ak)
+				aContainers = append(aContainers, cc)
 			}
 			ai++
 			bi++
@@ -109,6 +125,7 @@ func andContainersInRange(a, b *Bitmap, ai, aj int, optBuf []uint16) {
 		ac := a.getContainer(off)
 		zeroOutContainer(ac)
 	}
+	return
 }
 
 func AndNot(a, b *Bitmap) *Bitmap {
@@ -186,15 +203,19 @@ func andNotContainers(a, b, res *Bitmap, optBuf []uint16) {
 }
 
 func (ra *Bitmap) AndNot(bm *Bitmap) *Bitmap {
+	ra.prepareWrite()
 	if bm.IsEmpty() || ra.IsEmpty() {
 		return ra
 	}
 
+	var keys []uint64
+	var containers [][]uint16
 	if numContainersA, numContainersB := ra.keys.numKeys(), bm.keys.numKeys(); numContainersB < numContainersA {
-		andNotContainersInRangeB(ra, bm, 0, numContainersB, nil)
+		keys, containers = andNotContainersInRangeB(ra, bm, 0, numContainersB, nil)
 	} else {
-		andNotContainersInRangeA(ra, bm, 0, numContainersA, nil)
+		keys, containers = andNotContainersInRangeA(ra, bm, 0, numContainersA, nil)
 	}
+	ra.replaceContainers(keys, containers)
 
 	return ra
 }
@@ -210,6 +231,7 @@ func (ra *Bitmap) AndNot(bm *Bitmap) *Bitmap {
 // - maxConcurrency = 2, there will be 2 goroutines executed
 // - maxConcurrency = 6, there will be 4 goroutines executed
 func (ra *Bitmap) AndNotConc(bm *Bitmap, maxConcurrency int) *Bitmap {
+	ra.prepareWrite()
 	if bm.IsEmpty() || ra.IsEmpty() {
 		return ra
 	}
@@ -222,27 +244,37 @@ func (ra *Bitmap) AndNotConc(bm *Bitmap, maxConcurrency int) *Bitmap {
 	}
 
 	concurrency := calcConcurrency(numContainers, minContainersPerRoutine, maxConcurrency)
-	callback := func(i, j, _ int) { andNotCallback(ra, bm, i, j, nil) }
+	allKeys := make([][]uint64, concurrency)
+	allContainers := make([][][]uint16, concurrency)
+	callback := func(i, j, k int) {
+		allKeys[k], allContainers[k] = andNotCallback(ra, bm, i, j, nil)
+	}
 	concurrentlyInRanges(numContainers, concurrency, callback)
+	for i := range allKeys {
+		ra.replaceContainers(allKeys[i], allContainers[i])
+	}
 
 	return ra
 }
 
-func andNotContainersInRangeA(a, b *Bitmap, ai, aj int, optBuf []uint16) {
+func andNotContainersInRangeA(a, b *Bitmap, ai, aj int, optBuf []uint16) ([]uint64, [][]uint16) {
 	ak := a.keys.key(ai)
 	bi := b.keys.search(ak)
 	bn := b.keys.numKeys()
-	andNotContainersInRange(a, b, ai, aj, bi, bn, optBuf)
+	return andNotContainersInRange(a, b, ai, aj, bi, bn, optBuf)
 }
 
-func andNotContainersInRangeB(a, b *Bitmap, bi, bj int, optBuf []uint16) {
+func andNotContainersInRangeB(a, b *Bitmap, bi, bj int, optBuf []uint16) ([]uint64, [][]uint16) {
 	bk := b.keys.key(bi)
 	ai := a.keys.search(bk)
 	an := a.keys.numKeys()
-	andNotContainersInRange(a, b, ai, an, bi, bj, optBuf)
+	return andNotContainersInRange(a, b, ai, an, bi, bj, optBuf)
 }
 
-func andNotContainersInRange(a, b *Bitmap, ai, aj, bi, bj int, optBuf []uint16) {
+// andNotContainersInRange merges containers inline. Only run containers might not fit the result
+// of merge, such containers are copied and returned with their keys, to be placed by the caller.
+func andNotContainersInRange(a, b *Bitmap, ai, aj, bi, bj int, optBuf []uint16,
+) (aKeys []uint64, aContainers [][]uint16) {
 	for ai < aj && bi < bj {
 		ak := a.keys.key(ai)
 		bk := b.keys.key(bi)
@@ -252,7 +284,10 @@ func andNotContainersInRange(a, b *Bitmap, ai, aj, bi, bj int, optBuf []uint16)
 			off = b.keys.val(bi)
 			bc := b.getContainer(off)
 			if c := containerAndNotAlt(ac, bc, optBuf, runInline); len(c) > 0 {
-				panic("new container not expected in AndNot inline mode")
+				cc := make([]uint16, len(c))
+				copy(cc, c)
+				aKeys = append(aKeys, ak)
+				aContainers = append(aContainers, cc)
 			}
 			ai++
 			bi++
@@ -262,6 +297,26 @@ func andNotContainersInRange(a, b *Bitmap, ai, aj, bi, bj int, optBuf []uint16)
 			bi++
 		}
 	}
+	return
+}
+
+// replaceContainers replaces containers of existing keys with the given ones. New containers
+// are appended at the end of the data, the old ones are forgotten.
+func (ra *Bitmap) replaceContainers(keys []uint64, containers [][]uint16) {
+	if len(keys) == 0 {
+		return
+	}
+	var sizeContainers int
+	for _, c := range containers {
+		sizeContainers += len(c)
+	}
+	ra.expandConditionally(0, sizeContainers)
+
+	for i, c := range containers {
+		offset := ra.newContainerNoClr(uint16(len(c)))
+		copy(ra.data[offset:], c)
+		ra.setKey(keys[i], offset)
+	}
 }
 
 func Or(a, b *Bitmap) *Bitmap {
@@ -275,11 +330,15 @@ func Or(a, b *Bitmap) *Bitmap {
 	}
 
 	buf := make([]uint16, maxContainerSize)
-	orContainers(a, b, res, buf)
+	orContainers(a, b, res, buf, containerOrAlt)
 	return res
 }
 
-func orContainers(a, b, res *Bitmap, buf []uint16) {
+// containerMerger merges 2 containers. It is used to share merging code between Or and Xor,
+// which both keep containers present in only one of the bitmaps.
+type containerMerger func(ac, bc []uint16, buf []uint16, runMode int) []uint16
+
+func orContainers(a, b, res *Bitmap, buf []uint16, merge containerMerger) {
 	ai, an := 0, a.keys.numKeys()
 	bi, bn := 0, b.keys.numKeys()
 
@@ -296,7 +355,7 @@ func orContainers(a, b, res *Bitmap, buf []uint16) {
 			ac := a.getContainer(off)
 			off = b.keys.val(bi)
 			bc := b.getContainer(off)
-			if c := containerOrAlt(ac, bc, buf, 0); len(c) > 0 && getCardinality(c) > 0 {
+			if c := merge(ac, bc, buf, 0); len(c) > 0 && getCardinality(c) > 0 {
 				// Since buffer is used in containers merge, result container has to be copied
 				// to the bitmap immediately to let buffer be reused in next merge,
 				// contrary to unique containers from bitmap a and b copied at the end of method execution
@@ -368,15 +427,16 @@ func orContainers(a, b, res *Bitmap, buf []uint16) {
 }
 
 func (ra *Bitmap) Or(bm *Bitmap) *Bitmap {
+	ra.prepareWrite()
 	if bm.IsEmpty() {
 		return ra
 	}
 
-	orContainersInRange(ra, bm, 0, bm.keys.numKeys())
+	orContainersInRange(ra, bm, 0, bm.keys.numKeys(), containerOrAlt)
 	return ra
 }
 
-func orContainersInRange(a, b *Bitmap, bi, bn int) {
+func orContainersInRange(a, b *Bitmap, bi, bn int, merge containerMerger) {
 	buf := make([]uint16, maxContainerSize)
 
 	bk := b.keys.key(bi)
@@ -398,7 +458,7 @@ func orContainersInRange(a, b *Bitmap, bi, bn int) {
 			ac := a.getContainer(aoff)
 			boff := b.keys.val(bi)
 			bc := b.getContainer(boff)
-			if c := containerOrAlt(ac, bc, buf, runInline); len(c) > 0 {
+			if c := merge(ac, bc, buf, runInline); len(c) > 0 {
 				// Since buffer is used in containers merge, result container has to be copied
 				// to the bitmap immediately to let buffer be reused in next merge,
 				// contrary to unique containers from bitmap b copied at the end of method execution
@@ -485,6 +545,11 @@ func orContainersInRange(a, b *Bitmap, bi, bn int) {
 // - maxConcurrency = 2, there will be 2 goroutines executed
 // - maxConcurrency = 6, there will be 4 goroutines executed
 func (ra *Bitmap) OrConc(bm *Bitmap, maxConcurrency int) *Bitmap {
+	return ra.orConc(bm, maxConcurrency, containerOrAlt)
+}
+
+func (ra *Bitmap) orConc(bm *Bitmap, maxConcurrency int, merge containerMerger) *Bitmap {
+	ra.prepareWrite()
 	if bm.IsEmpty() {
 		return ra
 	}
@@ -493,7 +558,7 @@ func (ra *Bitmap) OrConc(bm *Bitmap, maxConcurrency int) *Bitmap {
 	concurrency := calcConcurrency(numContainers, minContainersPerRoutine, maxConcurrency)
 
 	if concurrency <= 1 {
-		orContainersInRange(ra, bm, 0, numContainers)
+		orContainersInRange(ra, bm, 0, numContainers, merge)
 		return ra
 	}
 
@@ -503,7 +568,7 @@ func (ra *Bitmap) OrConc(bm *Bitmap, maxConcurrency int) *Bitmap {
 	allContainers := make([][][]uint16, concurrency)
 	lock := new(sync.Mutex)
 	callback := func(bi, bj, i int) {
-		newKeys, sizeContainers, keys, containers := orContainersInRangeConc(ra, bm, bi, bj)
+		newKeys, sizeContainers, keys, containers := orContainersInRangeConc(ra, bm, bi, bj, merge)
 
 		lock.Lock()
 		totalNewKeys += newKeys
@@ -529,7 +594,7 @@ func (ra *Bitmap) OrConc(bm *Bitmap, maxConcurrency int) *Bitmap {
 	return ra
 }
 
-func orContainersInRangeConc(a, b *Bitmap, bi, bn int,
+func orContainersInRangeConc(a, b *Bitmap, bi, bn int, merge containerMerger,
 ) (newKeys, sizeContainers int, bKeys []uint64, bContainers [][]uint16) {
 	buf := make([]uint16, maxContainerSize)
 
@@ -552,7 +617,7 @@ func orContainersInRangeConc(a, b *Bitmap, bi, bn int,
 			ac := a.getContainer(off)
 			off = b.keys.val(bi)
 			bc := b.getContainer(off)
-			c := containerOrAlt(ac, bc, buf, runInline)
+			c := merge(ac, bc, buf, runInline)
 			if clen := len(c); clen > 0 {
 				cc := make([]uint16, clen)
 				copy(cc, c)
@@ -607,6 +672,229 @@ func orContainersInRangeConc(a, b *Bitmap, bi, bn int,
 	return
 }
 
+// Xor returns symmetric difference of given bitmaps, elements present in exactly one of them.
+func Xor(a, b *Bitmap) *Bitmap {
+	res := NewBitmap()
+	if ae, be := a.IsEmpty(), b.IsEmpty(); ae && be {
+		return res
+	} else if ae {
+		return b.Clone()
+	} else if be {
+		return a.Clone()
+	}
+
+	buf := make([]uint16, maxContainerSize)
+	orContainers(a, b, res, buf, containerXorAlt)
+	return res
+}
+
+// Xor performs symmetric difference inline, modifying current bitmap.
+func (ra *Bitmap) Xor(bm *Bitmap) *Bitmap {
+	ra.prepareWrite()
+	if bm.IsEmpty() {
+		return ra
+	}
+
+	orContainersInRange(ra, bm, 0, bm.keys.numKeys(), containerXorAlt)
+	return ra
+}
+
+// XorConc performs Xor merge concurrently.
+// Concurrency is calculated the same way as for OrConc.
+func (ra *Bitmap) XorConc(bm *Bitmap, maxConcurrency int) *Bitmap {
+	return ra.orConc(bm, maxConcurrency, containerXorAlt)
+}
+
+// FastXor returns symmetric difference of all given bitmaps, elements present in odd number
+// of them. Result is built by merging bitmaps inline, one by one, into a single result bitmap.
+func FastXor(bitmaps ...*Bitmap) *Bitmap {
+	switch len(bitmaps) {
+	case 0:
+		return NewBitmap()
+	case 1:
+		return bitmaps[0]
+	}
+
+	res := Xor(bitmaps[0], bitmaps[1])
+	for _, bm := range bitmaps[2:] {
+		res.Xor(bm)
+	}
+	return res
+}
+
+// AndCardinality returns cardinality of And(a, b), without materializing the result.
+func AndCardinality(a, b *Bitmap) int {
+	if a == nil || b == nil {
+		return 0
+	}
+
+	var num int
+	ai, an := 0, a.keys.numKeys()
+	bi, bn := 0, b.keys.numKeys()
+	for ai < an && bi < bn {
+		ak := a.keys.key(ai)
+		bk := b.keys.key(bi)
+		if ak == bk {
+			ac := a.getContainer(a.keys.val(ai))
+			bc := b.getContainer(b.keys.val(bi))
+			if getCardinality(ac) > 0 && getCardinality(bc) > 0 {
+				num += containerAndCardinality(ac, bc)
+			}
+			ai++
+			bi++
+		} else if ak < bk {
+			ai++
+		} else {
+			bi++
+		}
+	}
+	return num
+}
+
+// OrCardinality returns cardinality of Or(a, b), without materializing the result.
+func OrCardinality(a, b *Bitmap) int {
+	return a.GetCardinality() + b.GetCardinality() - AndCardinality(a, b)
+}
+
+// AndNotCardinality returns cardinality of AndNot(a, b), without materializing the result.
+func AndNotCardinality(a, b *Bitmap) int {
+	return a.GetCardinality() - AndCardinality(a, b)
+}
+
+// XorCardinality returns cardinality of Xor(a, b), without materializing the result.
+func XorCardinality(a, b *Bitmap) int {
+	return a.GetCardinality() + b.GetCardinality() - 2*AndCardinality(a, b)
+}
+
+// Intersects returns true if bitmaps have at least one element in common.
+func Intersects(a, b *Bitmap) bool {
+	if a == nil || b == nil {
+		return false
+	}
+
+	ai, an := 0, a.keys.numKeys()
+	bi, bn := 0, b.keys.numKeys()
+	for ai < an && bi < bn {
+		ak := a.keys.key(ai)
+		bk := b.keys.key(bi)
+		if ak == bk {
+			ac := a.getContainer(a.keys.val(ai))
+			bc := b.getContainer(b.keys.val(bi))
+			if getCardinality(ac) > 0 && getCardinality(bc) > 0 && containerIntersects(ac, bc) {
+				return true
+			}
+			ai++
+			bi++
+		} else if ak < bk {
+			ai++
+		} else {
+			bi++
+		}
+	}
+	return false
+}
+
+// Equals returns true if both bitmaps hold the same elements. Bitmaps are compared by their
+// content, regardless of types, sizes and order of underlying containers.
+func (ra *Bitmap) Equals(bm *Bitmap) bool {
+	if ra == bm {
+		return true
+	}
+	if ra == nil {
+		return bm.IsEmpty()
+	}
+	if bm == nil {
+		return ra.IsEmpty()
+	}
+
+	ai, an := 0, ra.keys.numKeys()
+	bi, bn := 0, bm.keys.numKeys()
+	for {
+		// empty containers are skipped, as they do not contribute to the content
+		for ai < an && getCardinality(ra.getContainer(ra.keys.val(ai))) == 0 {
+			ai++
+		}
+		for bi < bn && getCardinality(bm.getContainer(bm.keys.val(bi))) == 0 {
+			bi++
+		}
+		if ai == an || bi == bn {
+			return ai == an && bi == bn
+		}
+		if ra.keys.key(ai) != bm.keys.key(bi) {
+			return false
+		}
+		ac := ra.getContainer(ra.keys.val(ai))
+		bc := bm.getContainer(bm.keys.val(bi))
+		if !containerEquals(ac, bc) {
+			return false
+		}
+		ai++
+		bi++
+	}
+}
+
+// IsSubsetOf returns true if all elements of the bitmap are present in given bitmap.
+func (ra *Bitmap) IsSubsetOf(bm *Bitmap) bool {
+	if ra == nil || ra == bm {
+		return true
+	}
+	if bm == nil {
+		return ra.IsEmpty()
+	}
+
+	bi, bn := 0, bm.keys.numKeys()
+	for ai, an := 0, ra.keys.numKeys(); ai < an; ai++ {
+		ac := ra.getContainer(ra.keys.val(ai))
+		card := getCardinality(ac)
+		if card == 0 {
+			continue
+		}
+
+		ak := ra.keys.key(ai)
+		for bi < bn && bm.keys.key(bi) < ak {
+			bi++
+		}
+		if bi == bn || bm.keys.key(bi) != ak {
+			return false
+		}
+		bc := bm.getContainer(bm.keys.val(bi))
+		if getCardinality(bc) < card || containerAndCardinality(ac, bc) != card {
+			return false
+		}
+	}
+	return true
+}
+
+// IsSupersetOf returns true if all elements of given bitmap are present in the bitmap.
+func (ra *Bitmap) IsSupersetOf(bm *Bitmap) bool {
+	return bm.IsSubsetOf(ra)
+}
+
+// JaccardSimilarity returns |a ∩ b| / |a ∪ b|, value in range [0, 1].
+// Two empty bitmaps are considered identical, therefore 1 is returned.
+func JaccardSimilarity(a, b *Bitmap) float64 {
+	and := AndCardinality(a, b)
+	or := a.GetCardinality() + b.GetCardinality() - and
+	if or == 0 {
+		return 1
+	}
+	return float64(and) / float64(or)
+}
+
+// OverlapCoefficient returns |a ∩ b| / min(|a|, |b|), value in range [0, 1].
+// It equals 1 if one of the bitmaps is a subset of the other one. If only one of the bitmaps
+// is empty 0 is returned, if both are empty 1 is returned.
+func OverlapCoefficient(a, b *Bitmap) float64 {
+	acard, bcard := a.GetCardinality(), b.GetCardinality()
+	if acard == 0 && bcard == 0 {
+		return 1
+	}
+	if acard == 0 || bcard == 0 {
+		return 0
+	}
+	return float64(AndCardinality(a, b)) / float64(min(acard, bcard))
+}
+
 const minContainersPerRoutine = 24
 
 func calcConcurrency(numContainers, minContainers, maxConcurrency int) int {
@@ -656,17 +944,196 @@ func concurrentlyInRanges(numContainers, concurrency int, callback func(from, to
 }
 
 func (ra *Bitmap) ConvertToBitmapContainers() {
+	ra.prepareWrite()
 	for ai, an := 0, ra.keys.numKeys(); ai < an; ai++ {
 		ak := ra.keys.key(ai)
 		off := ra.keys.val(ai)
 		ac := ra.getContainer(off)
 
-		if ac[indexType] == typeArray {
-			c := array(ac).toBitmapContainer(nil)
-			offset := ra.newContainer(uint16(len(c)))
-			copy(ra.data[offset:], c)
-			ra.setKey(ak, offset)
+		var c []uint16
+		switch ac[indexType] {
+		case typeArray:
+			c = array(ac).toBitmapContainer(nil)
+		case typeRun:
+			c = run(ac).toBitmapContainer(nil)
+		default:
+			continue
+		}
+		offset := ra.newContainer(uint16(len(c)))
+		copy(ra.data[offset:], c)
+		ra.setKey(ak, offset)
+	}
+}
+
+// Optimize converts each container to its most compact representation (array, bitmap or run),
+// drops empty containers and rewrites the underlying buffer, so it has no unused space left.
+// Returns number of bytes saved.
+func (ra *Bitmap) Optimize() int {
+	if ra == nil {
+		return 0
+	}
+	ra.prepareWrite()
+
+	n := ra.keys.numKeys()
+	keys := make([]uint64, 0, n)
+	containers := make([][]uint16, 0, n)
+	var sizeContainers int
+	for i := 0; i < n; i++ {
+		c := ra.getContainer(ra.keys.val(i))
+		// Container for key = 0 is always kept.
+		if i > 0 && getCardinality(c) == 0 {
+			continue
+		}
+		c = compactContainer(c)
+		keys = append(keys, ra.keys.key(i))
+		containers = append(containers, c)
+		sizeContainers += len(c)
+	}
+
+	res := fromContainers(keys, containers, sizeContainers)
+	saved := ra.LenInBytes() - res.LenInBytes()
+	ra.data = res.data
+	ra._ptr = nil
+	ra.keys = res.keys
+	return saved
+}
+
+// fromContainers creates a bitmap out of sorted keys and their containers, which are copied
+// one after another with no additional space. First key has to be 0.
+func fromContainers(keys []uint64, containers [][]uint16, sizeContainers int) *Bitmap {
+	// Reserve space for 1 additional key, as keys node can not be full.
+	keysLen := calcInitialKeysLen(len(keys) + 1)
+	data := make([]uint16, keysLen, keysLen+sizeContainers)
+	keysNode := node(toUint64Slice(data))
+	keysNode.setNodeSize(keysLen)
+	keysNode.setNumKeys(len(keys))
+	for i, c := range containers {
+		keysNode.setAt(keyOffset(i), keys[i])
+		keysNode.setAt(valOffset(i), uint64(len(data)))
+		data = append(data, c...)
+	}
+	return &Bitmap{data: data, keys: toUint64Slice(data[:keysLen])}
+}
+
+// SubBitmap returns a new bitmap with the elements in the range [lo, hi). Only the containers
+// intersecting the range are copied, the ones on the edges of the range are trimmed.
+func (ra *Bitmap) SubBitmap(lo, hi uint64) *Bitmap {
+	if ra == nil || lo >= hi {
+		return NewBitmap()
+	}
+
+	k1, k2 := lo&mask, (hi-1)&mask
+	// Container for key = 0 is always present.
+	keys := []uint64{0}
+	containers := [][]uint16{{uint16(startIdx), typeArray, 0, 0}}
+	sizeContainers := int(startIdx)
+
+	n := ra.keys.numKeys()
+	for i := ra.keys.search(k1); i < n; i++ {
+		key := ra.keys.key(i)
+		if key < k1 {
+			continue
+		}
+		if key > k2 {
+			break
+		}
+		c := ra.getContainer(ra.keys.val(i))
+		if getCardinality(c) == 0 {
+			continue
+		}
+		if key == k1 || key == k2 {
+			// Trimming edges of the container never splits a run, so no additional space
+			// is needed for run containers.
+			c = append([]uint16(nil), c...)
+			if key == k1 && uint16(lo) > 0 {
+				removeRangeContainer(c, 0, uint16(lo)-1)
+			}
+			if key == k2 && uint16(hi-1) < math.MaxUint16 {
+				removeRangeContainer(c, uint16(hi-1)+1, math.MaxUint16)
+			}
+			if getCardinality(c) == 0 {
+				continue
+			}
+		}
+		if key == 0 {
+			containers[0] = c
+			sizeContainers = len(c)
+			continue
+		}
+		keys = append(keys, key)
+		containers = append(containers, c)
+		sizeContainers += len(c)
+	}
+	return fromContainers(keys, containers, sizeContainers)
+}
+
+// compactContainer returns the smallest representation of the container. Returned container has
+// no unused space. The container itself is returned if it is already the smallest one.
+func compactContainer(c []uint16) []uint16 {
+	card := getCardinality(c)
+	arraySize := int(startIdx) + card
+	var numRuns int
+	switch c[indexType] {
+	case typeArray:
+		numRuns = array(c).numRuns()
+	case typeBitmap:
+		numRuns = bitmap(c).numRuns()
+	case typeRun:
+		numRuns = run(c).numRuns()
+	}
+	runsSize := runSize(numRuns)
+	// Just like in expandContainer, arrays with more than 2048 elements become bitmaps.
+	isArray := card <= 2048
+	minSize := maxContainerSize
+	if isArray {
+		minSize = arraySize
+	}
+
+	// Prefer array and bitmap containers over run containers of the same size.
+	switch {
+	case runsSize < minSize:
+		switch c[indexType] {
+		case typeArray:
+			return array(c).toRunContainer(nil)
+		case typeBitmap:
+			return bitmap(c).toRunContainer(nil)
 		}
+		if len(c) == runsSize {
+			return c
+		}
+		out := make([]uint16, runsSize)
+		copy(out, c)
+		out[indexSize] = uint16(runsSize)
+		return out
+
+	case isArray:
+		if c[indexType] == typeArray && len(c) == arraySize {
+			return c
+		}
+		var vals []uint16
+		switch c[indexType] {
+		case typeArray:
+			vals = array(c).all()
+		case typeBitmap:
+			vals = bitmap(c).all()
+		case typeRun:
+			vals = run(c).all()
+		}
+		out := make([]uint16, arraySize)
+		out[indexSize] = uint16(arraySize)
+		out[indexType] = typeArray
+		setCardinality(out, card)
+		copy(out[startIdx:], vals)
+		return out
+
+	default:
+		switch c[indexType] {
+		case typeArray:
+			return array(c).toBitmapContainer(nil)
+		case typeRun:
+			return run(c).toBitmapContainer(nil)
+		}
+		return c
 	}
 }
 
@@ -726,6 +1193,8 @@ func (ra *Bitmap) CloneToBuf(buf []byte) *Bitmap {
 	// adjust length to src length, keep capacity as entire buffer
 	bm := FromBuffer(dstbuf)
 	bm.data = bm.data[:srclen/2]
+	// The buffer is given for the clone to use.
+	bm.readOnly = false
 	return bm
 }
 
@@ -772,6 +1241,7 @@ func (ra *Bitmap) FillUp(maxX uint64) {
 	if ra == nil {
 		return
 	}
+	ra.prepareWrite()
 
 	maxContainersCount, maxRemainingCount := calcFullContainersAndRemainingCounts(maxX)
 	if ra.IsEmpty() {
@@ -841,6 +1311,12 @@ func (ra *Bitmap) FillUp(maxX uint64) {
 					commonContainer[startIdx+y/16] |= bitmapMask[y%16]
 				}
 			}
+		case typeRun:
+			// minY is the maximum, therefore it ends the last run. extend it
+			r := run(commonContainer)
+			n := r.numRuns() - 1
+			r.setRun(n, r.start(n), uint16(maxY))
+			setCardinality(commonContainer, card+newYs)
 		default:
 			panic("unknown container type")
 		}
@@ -897,6 +1373,14 @@ func (ra *Bitmap) FillUp(maxX uint64) {
 					}
 				}
 			}
+		case typeRun:
+			// if run, extend the last run up to maxCardinality
+			fillUpCommonContainer = func(commonContainer []uint16, onesBitmap bitmap) {
+				r := run(commonContainer)
+				n := r.numRuns() - 1
+				r.setRun(n, r.start(n), math.MaxUint16)
+				setCardinality(commonContainer, card+newYs)
+			}
 		default:
 			panic("unknown container type")
 		}
@@ -931,6 +1415,223 @@ func (ra *Bitmap) FillUp(maxX uint64) {
 	}
 }
 
+// AddRange adds all elements in range [lo, hi) to the bitmap.
+// Containers fully covered by the range are replaced with full bitmap containers,
+// containers partially covered are converted to bitmap containers with bits of the range set.
+func (ra *Bitmap) AddRange(lo, hi uint64) {
+	ra.prepareWrite()
+	if lo > hi {
+		panic("lo should not be more than hi")
+	}
+	if lo == hi {
+		return
+	}
+	// small ranges are cheaper to add element by element, keeping array containers as they are
+	if hi-lo < minContainerSize {
+		for x := lo; x < hi; x++ {
+			ra.Set(x)
+		}
+		return
+	}
+
+	first := lo & mask
+	last := (hi - 1) & mask
+	step := uint64(maxCardinality)
+
+	// first count how many new containers will be required to allocate memory once
+	var newKeys, sizeContainers int
+	for key := first; ; key += step {
+		if off, has := ra.keys.getValue(key); !has {
+			newKeys++
+			sizeContainers += maxContainerSize
+		} else if ra.getContainer(off)[indexType] != typeBitmap {
+			sizeContainers += maxContainerSize
+		}
+		if key == last {
+			break
+		}
+	}
+	ra.expandConditionally(newKeys, sizeContainers)
+
+	for key := first; ; key += step {
+		minY, maxY := 0, math.MaxUint16
+		if key == first {
+			minY = int(uint16(lo))
+		}
+		if key == last {
+			maxY = int(uint16(hi - 1))
+		}
+		ra.addRangeAt(key, minY, maxY)
+		if key == last {
+			break
+		}
+	}
+}
+
+// addRangeAt sets bits in range minY-maxY (both included) in container of given key.
+// Container is converted to bitmap or created if it does not exist yet.
+func (ra *Bitmap) addRangeAt(key uint64, minY, maxY int) {
+	off, has := ra.keys.getValue(key)
+	if has {
+		if c := ra.getContainer(off); c[indexType] == typeBitmap {
+			bitmap(c).addRange(minY, maxY)
+			return
+		}
+	}
+
+	offset := ra.newContainer(maxContainerSize)
+	b := bitmap(ra.getContainer(offset))
+	b[indexType] = typeBitmap
+	if has {
+		switch c := ra.getContainer(off); c[indexType] {
+		case typeArray:
+			for _, x := range array(c).all() {
+				b[startIdx+x>>4] |= bitmapMask[x&0xF]
+			}
+		case typeRun:
+			b.setRuns(run(c))
+		}
+	}
+	b.addRange(minY, maxY)
+	ra.setKey(key, offset)
+}
+
+// addRange sets bits in range minY-maxY (both included) and updates cardinality.
+func (b bitmap) addRange(minY, maxY int) {
+	if minY == 0 && maxY == math.MaxUint16 {
+		b.fillWithOnes()
+		setCardinality(b, maxCardinality)
+		return
+	}
+	b.setRange(minY, maxY, nil)
+	setCardinality(b, b.cardinality())
+}
+
+// Flip inverts elements in range [lo, hi). Elements present in the bitmap are removed,
+// missing ones are added.
+func (ra *Bitmap) Flip(lo, hi uint64) {
+	ra.prepareWrite()
+	if lo > hi {
+		panic("lo should not be more than hi")
+	}
+	if lo == hi {
+		return
+	}
+	// small ranges are cheaper to flip element by element
+	if hi-lo < minContainerSize {
+		for x := lo; x < hi; x++ {
+			if !ra.Remove(x) {
+				ra.Set(x)
+			}
+		}
+		return
+	}
+
+	first := lo & mask
+	last := (hi - 1) & mask
+	step := uint64(maxCardinality)
+
+	// first count how many new containers will be required to allocate memory once.
+	// bitmap containers are flipped in place, others are replaced with new containers.
+	var newKeys, sizeContainers int
+	for key := first; ; key += step {
+		if off, has := ra.keys.getValue(key); !has {
+			newKeys++
+			sizeContainers += maxContainerSize
+		} else if ra.getContainer(off)[indexType] != typeBitmap {
+			sizeContainers += maxContainerSize
+		}
+		if key == last {
+			break
+		}
+	}
+	ra.expandConditionally(newKeys, sizeContainers)
+
+	for key := first; ; key += step {
+		minY, maxY := 0, math.MaxUint16
+		if key == first {
+			minY = int(uint16(lo))
+		}
+		if key == last {
+			maxY = int(uint16(hi - 1))
+		}
+		ra.flipRangeAt(key, minY, maxY)
+		if key == last {
+			break
+		}
+	}
+}
+
+// Flip returns a copy of the bitmap with elements in range [lo, hi) inverted.
+func Flip(bm *Bitmap, lo, hi uint64) *Bitmap {
+	res := bm.Clone()
+	res.Flip(lo, hi)
+	return res
+}
+
+// flipRangeAt inverts elements in range minY-maxY (both included) in container of given key.
+// Array containers are complemented into new array or bitmap container, depending on resulting
+// cardinality. Run containers are converted to bitmaps.
+func (ra *Bitmap) flipRangeAt(key uint64, minY, maxY int) {
+	off, has := ra.keys.getValue(key)
+	if !has {
+		ra.addRangeAt(key, minY, maxY)
+		return
+	}
+
+	c := ra.getContainer(off)
+	switch c[indexType] {
+	case typeBitmap:
+		bitmap(c).flipRange(uint16(minY), uint16(maxY))
+		return
+	case typeArray:
+		vals := array(c).all()
+		lo := array(c).find(uint16(minY))
+		hi := array(c).find(uint16(maxY))
+		if hi < len(vals) && int(vals[hi]) == maxY {
+			hi++
+		}
+		inRange := hi - lo
+		card := len(vals) - inRange + (maxY - minY + 1 - inRange)
+
+		if card <= 2048 {
+			offset := ra.newContainer(roundSize(uint16(int(startIdx) + card)))
+			vals = array(ra.getContainer(off)).all()
+			out := ra.getContainer(offset)
+			out[indexType] = typeArray
+			setCardinality(out, card)
+
+			n := copy(out[startIdx:], vals[:lo])
+			i := lo
+			for y := minY; y <= maxY; y++ {
+				if i < hi && int(vals[i]) == y {
+					i++
+					continue
+				}
+				out[int(startIdx)+n] = uint16(y)
+				n++
+			}
+			copy(out[int(startIdx)+n:], vals[hi:])
+			ra.setKey(key, offset)
+			return
+		}
+	}
+
+	offset := ra.newContainer(maxContainerSize)
+	b := bitmap(ra.getContainer(offset))
+	b[indexType] = typeBitmap
+	switch c := ra.getContainer(off); c[indexType] {
+	case typeArray:
+		for _, x := range array(c).all() {
+			b[startIdx+x>>4] |= bitmapMask[x&0xF]
+		}
+	case typeRun:
+		b.setRuns(run(c))
+	}
+	b.flipRange(uint16(minY), uint16(maxY))
+	ra.setKey(key, offset)
+}
+
 // prefill prefills containersCount full containers
 // and last one with remainingCount first values
 func (ra *Bitmap) prefill(containersCount, remainingCount int) {
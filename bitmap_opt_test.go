@@ -2,6 +2,7 @@ package sroar
 
 import (
 	"fmt"
+	"math"
 	"math/bits"
 	"math/rand"
 	"slices"
@@ -686,6 +687,13 @@ func TestCompareMergeImplementationsConcurrent(t *testing.T) {
 		assertMatches(t, bmOr, bmOrConc)
 	})
 
+	t.Run("xor", func(t *testing.T) {
+		bmXor := bm1.Clone().Xor(bm2).Xor(bm3)
+		bmXorConc := bm1.Clone().XorConc(bm2, 4).XorConc(bm3, 8)
+
+		assertMatches(t, bmXor, bmXorConc)
+	})
+
 	t.Run("mixed", func(t *testing.T) {
 		bmMix := bm1.Clone().Or(bm2).And(bm3).AndNot(bm1)
 		bmMixConc := bm1.Clone().OrConc(bm2, 4).AndConc(bm3, 8).AndNotConc(bm1, 6)
@@ -2434,17 +2442,17 @@ func assertMatches(t *testing.T, expected *Bitmap, others ...*Bitmap) {
 		iterators[i] = others[i].NewIterator()
 	}
 
-	for j := 0; ; j++ {
+	for j := 0; iterator.HasNext(); j++ {
 		x := iterator.Next()
 		for i := range iterators {
+			require.Truef(t, iterators[i].HasNext(), "missing element at position %d for bitmap %d", j, i)
 			xi := iterators[i].Next()
 
 			require.Equalf(t, x, xi, "different elements at position %d for bitmap %d", j, i)
 		}
-
-		if j > 0 && x == 0 {
-			break
-		}
+	}
+	for i := range iterators {
+		require.Falsef(t, iterators[i].HasNext(), "unexpected elements for bitmap %d", i)
 	}
 }
 
@@ -2667,3 +2675,715 @@ func TestExpandConditionally(t *testing.T) {
 		})
 	})
 }
+
+func TestXor(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	maxX := int64(8 * maxCardinality)
+
+	// array, bitmap and full containers, with overlapping and exclusive keys
+	bitmaps := make([]*Bitmap, 4)
+	for i := range bitmaps {
+		bitmaps[i] = NewBitmap()
+	}
+	for i := 0; i < 60_000; i++ {
+		x := uint64(rnd.Int63n(maxX))
+		bitmaps[i%len(bitmaps)].Set(x)
+	}
+	for i := 0; i < 1000; i++ {
+		bitmaps[0].Set(uint64(3*maxCardinality + rnd.Intn(maxCardinality)))
+		bitmaps[1].Set(uint64(9*maxCardinality + rnd.Intn(maxCardinality)))
+	}
+	bitmaps[2].FillUp(uint64(2*maxCardinality + 100))
+	bitmaps[3].FillUp(uint64(maxCardinality / 2))
+
+	expectedXor := func(bms ...*Bitmap) *Bitmap {
+		counts := map[uint64]int{}
+		for _, bm := range bms {
+			for _, x := range bm.ToArray() {
+				counts[x]++
+			}
+		}
+		res := NewBitmap()
+		for x, cnt := range counts {
+			if cnt%2 == 1 {
+				res.Set(x)
+			}
+		}
+		return res
+	}
+
+	for i := range bitmaps {
+		for j := range bitmaps {
+			a, b := bitmaps[i], bitmaps[j]
+			t.Run(fmt.Sprintf("%d xor %d", i, j), func(t *testing.T) {
+				expected := expectedXor(a, b)
+				if i == j {
+					require.True(t, expected.IsEmpty())
+				}
+
+				assertMatches(t, expected,
+					Xor(a, b),
+					a.Clone().Xor(b),
+					a.Clone().XorConc(b, 4),
+					Xor(toRunBitmap(a), b),
+					toRunBitmap(a).Xor(toRunBitmap(b)),
+					FastXor(a, b),
+				)
+				require.Equal(t, expected.GetCardinality(), Or(a, b).AndNot(And(a, b)).GetCardinality())
+			})
+		}
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		empty := NewBitmap()
+		assertMatches(t, bitmaps[0], Xor(empty, bitmaps[0]), Xor(bitmaps[0], empty), NewBitmap().Xor(bitmaps[0]))
+		assertMatches(t, empty, Xor(empty, empty), FastXor())
+	})
+
+	t.Run("fast xor", func(t *testing.T) {
+		assertMatches(t, expectedXor(bitmaps...), FastXor(bitmaps...))
+		assertMatches(t, bitmaps[1], FastXor(bitmaps[1]))
+	})
+}
+
+func TestCardinalityOps(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	maxX := int64(6 * maxCardinality)
+
+	bitmaps := make([]*Bitmap, 4)
+	for i := range bitmaps {
+		bitmaps[i] = NewBitmap()
+	}
+	for i := 0; i < 40_000; i++ {
+		x := uint64(rnd.Int63n(maxX))
+		bitmaps[i%2].Set(x)
+	}
+	for i := 0; i < 2000; i++ {
+		bitmaps[2].Set(uint64(rnd.Int63n(maxX)))
+	}
+	bitmaps[3].FillUp(uint64(2*maxCardinality + 100))
+	bitmaps[3].RemoveRange(1000, 5000)
+	bitmaps = append(bitmaps, toRunBitmap(bitmaps[0]), toRunBitmap(bitmaps[2]), toRunBitmap(bitmaps[3]))
+
+	for i, a := range bitmaps {
+		for j, b := range bitmaps {
+			t.Run(fmt.Sprintf("%d and %d", i, j), func(t *testing.T) {
+				and := And(a, b).GetCardinality()
+				require.Equal(t, and, AndCardinality(a, b))
+				require.Equal(t, Or(a, b).GetCardinality(), OrCardinality(a, b))
+				require.Equal(t, AndNot(a, b).GetCardinality(), AndNotCardinality(a, b))
+				require.Equal(t, Xor(a, b).GetCardinality(), XorCardinality(a, b))
+				require.Equal(t, and > 0, Intersects(a, b))
+			})
+		}
+	}
+
+	t.Run("disjoint", func(t *testing.T) {
+		a := NewBitmap()
+		b := NewBitmap()
+		for x := uint64(0); x < uint64(3*maxCardinality); x++ {
+			if x%2 == 0 {
+				a.Set(x)
+			} else {
+				b.Set(x)
+			}
+		}
+		require.False(t, Intersects(a, b))
+		require.False(t, Intersects(toRunBitmap(a), b))
+		require.Equal(t, 0, AndCardinality(a, b))
+		require.Equal(t, 3*maxCardinality, XorCardinality(a, b))
+	})
+
+	t.Run("nil and empty", func(t *testing.T) {
+		require.Equal(t, 0, AndCardinality(nil, bitmaps[0]))
+		require.Equal(t, bitmaps[0].GetCardinality(), OrCardinality(nil, bitmaps[0]))
+		require.Equal(t, bitmaps[0].GetCardinality(), AndNotCardinality(bitmaps[0], NewBitmap()))
+		require.False(t, Intersects(NewBitmap(), bitmaps[0]))
+	})
+
+	t.Run("no allocations", func(t *testing.T) {
+		a, b := bitmaps[0], bitmaps[4]
+		allocs := testing.AllocsPerRun(10, func() {
+			AndCardinality(a, b)
+			OrCardinality(a, b)
+			AndNotCardinality(a, b)
+			XorCardinality(a, b)
+			Intersects(a, b)
+		})
+		require.Equal(t, 0.0, allocs)
+	})
+}
+
+func TestEqualsAndSubsets(t *testing.T) {
+	maxCard := uint64(maxCardinality)
+	rnd := rand.New(rand.NewSource(1))
+	bm := NewBitmap()
+	for i := 0; i < 30_000; i++ {
+		bm.Set(rnd.Uint64() % (4 * maxCard))
+	}
+	bm.FillUp(5*maxCard + 10)
+	bm.RemoveRange(0, 1000)
+
+	t.Run("equal bitmaps with different layouts", func(t *testing.T) {
+		// empty containers left behind
+		withEmpty := bm.Clone()
+		withEmpty.Set(10 * maxCard)
+		withEmpty.Remove(10 * maxCard)
+
+		optimized := bm.Clone()
+		optimized.Optimize()
+
+		bitmapsOnly := bm.Clone()
+		bitmapsOnly.ConvertToBitmapContainers()
+
+		for i, other := range []*Bitmap{bm, bm.Clone(), withEmpty, optimized, bitmapsOnly, toRunBitmap(bm)} {
+			require.Truef(t, bm.Equals(other), "bitmap %d", i)
+			require.Truef(t, other.Equals(bm), "bitmap %d", i)
+			require.Truef(t, bm.IsSubsetOf(other), "bitmap %d", i)
+			require.Truef(t, bm.IsSupersetOf(other), "bitmap %d", i)
+			require.Equalf(t, 1.0, JaccardSimilarity(bm, other), "bitmap %d", i)
+		}
+	})
+
+	t.Run("different bitmaps", func(t *testing.T) {
+		subset := bm.Clone()
+		subset.Remove(bm.Maximum())
+		subset.RemoveRange(maxCard, 2*maxCard)
+		superset := bm.Clone()
+		superset.Set(100 * maxCard)
+
+		for _, other := range []*Bitmap{subset, toRunBitmap(subset)} {
+			require.False(t, bm.Equals(other))
+			require.False(t, other.Equals(bm))
+			require.True(t, other.IsSubsetOf(bm))
+			require.False(t, other.IsSupersetOf(bm))
+			require.False(t, bm.IsSubsetOf(other))
+			require.True(t, bm.IsSupersetOf(other))
+			require.Equal(t, 1.0, OverlapCoefficient(bm, other))
+		}
+		require.False(t, bm.Equals(superset))
+		require.True(t, bm.IsSubsetOf(superset))
+		require.False(t, superset.IsSubsetOf(bm))
+
+		moved := bm.Clone()
+		moved.Remove(bm.Minimum())
+		moved.Set(bm.Minimum() - 1)
+		require.False(t, bm.Equals(moved))
+		require.False(t, bm.IsSubsetOf(moved))
+		require.False(t, moved.IsSubsetOf(bm))
+	})
+
+	t.Run("nil and empty", func(t *testing.T) {
+		var nilBm *Bitmap
+		empty := NewBitmap()
+		require.True(t, nilBm.Equals(empty))
+		require.True(t, empty.Equals(nilBm))
+		require.True(t, nilBm.IsSubsetOf(bm))
+		require.True(t, empty.IsSubsetOf(bm))
+		require.False(t, bm.IsSubsetOf(nilBm))
+		require.True(t, bm.IsSupersetOf(empty))
+		require.False(t, bm.Equals(empty))
+	})
+}
+
+func TestSimilarity(t *testing.T) {
+	a := NewBitmap()
+	b := NewBitmap()
+	for x := uint64(0); x < 3000; x++ {
+		a.Set(x)
+	}
+	for x := uint64(1000); x < 5000; x++ {
+		b.Set(x)
+	}
+
+	require.InDelta(t, 2000.0/5000.0, JaccardSimilarity(a, b), 1e-9)
+	require.InDelta(t, 2000.0/3000.0, OverlapCoefficient(a, b), 1e-9)
+	require.Equal(t, 0.0, JaccardSimilarity(a, NewBitmap()))
+	require.Equal(t, 0.0, OverlapCoefficient(a, NewBitmap()))
+	require.Equal(t, 1.0, JaccardSimilarity(NewBitmap(), nil))
+	require.Equal(t, 1.0, OverlapCoefficient(NewBitmap(), nil))
+}
+
+func TestAddRange(t *testing.T) {
+	maxCard := uint64(maxCardinality)
+
+	expectedWithRange := func(bm *Bitmap, lo, hi uint64) *Bitmap {
+		exp := bm.Clone()
+		for x := lo; x < hi; x++ {
+			exp.Set(x)
+		}
+		return exp
+	}
+
+	ranges := []struct {
+		name   string
+		lo, hi uint64
+	}{
+		{"empty range", 100, 100},
+		{"small range", 100, 120},
+		{"within single container", 100, 5000},
+		{"whole container", maxCard, 2 * maxCard},
+		{"whole container and edge", maxCard, 2*maxCard + 1},
+		{"edges only", maxCard - 10, maxCard + 10},
+		{"multiple containers", 1234, 3*maxCard + 4321},
+		{"far containers", 100*maxCard - 17, 102 * maxCard},
+	}
+
+	initial := map[string]func() *Bitmap{
+		"empty": NewBitmap,
+		"arrays": func() *Bitmap {
+			bm := NewBitmap()
+			for x := uint64(0); x < 8*maxCard; x += 997 {
+				bm.Set(x)
+			}
+			return bm
+		},
+		"bitmaps": func() *Bitmap {
+			bm := NewBitmap()
+			for x := uint64(0); x < 8*maxCard; x += 7 {
+				bm.Set(x)
+			}
+			return bm
+		},
+		"runs": func() *Bitmap {
+			bm := NewBitmap()
+			for x := uint64(0); x < 8*maxCard; x += 1000 {
+				for y := x; y < x+100; y++ {
+					bm.Set(y)
+				}
+			}
+			return toRunBitmap(bm)
+		},
+	}
+
+	for name, create := range initial {
+		for _, r := range ranges {
+			t.Run(fmt.Sprintf("%s %s", name, r.name), func(t *testing.T) {
+				bm := create()
+				expected := expectedWithRange(bm, r.lo, r.hi)
+
+				bm.AddRange(r.lo, r.hi)
+				assertMatches(t, expected, bm)
+				if r.lo < r.hi {
+					require.True(t, bm.Contains(r.lo))
+					require.True(t, bm.Contains(r.hi-1))
+				}
+
+				// bitmap is still modifiable
+				bm.Set(200 * maxCard)
+				bm.Remove(r.lo)
+				expected.Set(200 * maxCard)
+				expected.Remove(r.lo)
+				assertMatches(t, expected, bm)
+			})
+		}
+	}
+
+	t.Run("reused capacity", func(t *testing.T) {
+		// Containers created in the space left by the previous contents have to be cleared.
+		for name, clear := range map[string]func(bm *Bitmap){
+			"reset":        func(bm *Bitmap) { bm.Reset() },
+			"remove range": func(bm *Bitmap) { bm.RemoveRange(0, 4*maxCard); bm.Cleanup() },
+		} {
+			bm := NewBitmap()
+			bm.AddRange(0, 4*maxCard)
+			clear(bm)
+			bm.AddRange(maxCard, maxCard+100)
+			require.Equalf(t, 100, bm.GetCardinality(), "after %s", name)
+			bm.AddRange(3*maxCard+10, 5*maxCard)
+			require.Equalf(t, int(2*maxCard)+90, bm.GetCardinality(), "after %s", name)
+		}
+	})
+
+	t.Run("invalid range", func(t *testing.T) {
+		require.Panics(t, func() { NewBitmap().AddRange(10, 9) })
+	})
+}
+
+func TestFlip(t *testing.T) {
+	maxCard := uint64(maxCardinality)
+
+	expectedFlipped := func(bm *Bitmap, lo, hi uint64) *Bitmap {
+		exp := bm.Clone()
+		for x := lo; x < hi; x++ {
+			if exp.Contains(x) {
+				exp.Remove(x)
+			} else {
+				exp.Set(x)
+			}
+		}
+		return exp
+	}
+
+	ranges := []struct {
+		name   string
+		lo, hi uint64
+	}{
+		{"empty range", 100, 100},
+		{"small range", 100, 120},
+		{"within single container", 100, 5000},
+		{"within single word", 17, 95},
+		{"whole container", maxCard, 2 * maxCard},
+		{"edges only", maxCard - 10, maxCard + 10},
+		{"multiple containers", 1234, 3*maxCard + 4321},
+		{"far containers", 100*maxCard - 17, 101*maxCard + 5},
+	}
+
+	initial := map[string]func() *Bitmap{
+		"empty": NewBitmap,
+		"arrays": func() *Bitmap {
+			bm := NewBitmap()
+			for x := uint64(0); x < 4*maxCard; x += 997 {
+				bm.Set(x)
+			}
+			return bm
+		},
+		"dense arrays": func() *Bitmap {
+			bm := NewBitmap()
+			for x := uint64(0); x < 4*maxCard; x += 17 {
+				bm.Set(x)
+			}
+			bm.Optimize()
+			return bm
+		},
+		"bitmaps": func() *Bitmap {
+			bm := NewBitmap()
+			for x := uint64(0); x < 4*maxCard; x += 7 {
+				bm.Set(x)
+			}
+			return bm
+		},
+		"runs": func() *Bitmap {
+			bm := NewBitmap()
+			for x := uint64(0); x < 4*maxCard; x += 1000 {
+				for y := x; y < x+100; y++ {
+					bm.Set(y)
+				}
+			}
+			return toRunBitmap(bm)
+		},
+	}
+
+	for name, create := range initial {
+		for _, r := range ranges {
+			t.Run(fmt.Sprintf("%s %s", name, r.name), func(t *testing.T) {
+				bm := create()
+				orig := bm.Clone()
+				expected := expectedFlipped(bm, r.lo, r.hi)
+
+				flipped := Flip(bm, r.lo, r.hi)
+				assertMatches(t, expected, flipped)
+				assertMatches(t, orig, bm)
+
+				bm.Flip(r.lo, r.hi)
+				assertMatches(t, expected, bm)
+
+				bm.Flip(r.lo, r.hi)
+				assertMatches(t, orig, bm)
+			})
+		}
+	}
+
+	t.Run("complement", func(t *testing.T) {
+		bm := NewBitmap()
+		bm.SetMany([]uint64{0, 5, 1000, maxCard + 3})
+		bm.Flip(0, 2*maxCard)
+
+		require.Equal(t, int(2*maxCard)-4, bm.GetCardinality())
+		require.False(t, bm.Contains(0))
+		require.True(t, bm.Contains(1))
+		require.False(t, bm.Contains(maxCard+3))
+		require.Equal(t, 2*maxCard-1, bm.Maximum())
+	})
+
+	t.Run("large arrays become bitmaps", func(t *testing.T) {
+		bm := NewBitmap()
+		bm.SetMany([]uint64{1, 3, 5000})
+		bm.Flip(10, 3000)
+		bm.Flip(4000, 4100)
+
+		require.Equal(t, typeBitmap, bm.getContainer(bm.keys.val(0))[indexType])
+		require.Equal(t, 3+2990+100, bm.GetCardinality())
+		require.True(t, bm.Contains(2999))
+		require.False(t, bm.Contains(3000))
+		require.True(t, bm.Contains(5000))
+	})
+
+	t.Run("reused capacity", func(t *testing.T) {
+		// Containers created in the space left by the previous contents have to be cleared.
+		bm := NewBitmap()
+		bm.AddRange(0, 4*maxCard)
+		bm.Reset()
+		bm.Flip(maxCard, maxCard+100)
+		require.Equal(t, 100, bm.GetCardinality())
+		bm.Flip(2*maxCard+10, 3*maxCard)
+		require.Equal(t, int(maxCard)+90, bm.GetCardinality())
+		bm.Flip(maxCard, 3*maxCard)
+		require.Equal(t, int(maxCard)-90, bm.GetCardinality())
+	})
+
+	t.Run("invalid range", func(t *testing.T) {
+		require.Panics(t, func() { NewBitmap().Flip(10, 9) })
+	})
+}
+
+func TestOptimize(t *testing.T) {
+	maxCard := uint64(maxCardinality)
+
+	containerTypes := func(bm *Bitmap) []uint16 {
+		var types []uint16
+		for i := 0; i < bm.keys.numKeys(); i++ {
+			types = append(types, bm.getContainer(bm.keys.val(i))[indexType])
+		}
+		return types
+	}
+
+	t.Run("empty bitmap", func(t *testing.T) {
+		bm := NewBitmap()
+		saved := bm.Optimize()
+
+		require.Greater(t, saved, 0)
+		require.True(t, bm.IsEmpty())
+		require.Equal(t, 1, bm.keys.numKeys())
+
+		bm.Set(1)
+		require.Equal(t, []uint64{1}, bm.ToArray())
+	})
+
+	t.Run("sparse bitmap containers become arrays", func(t *testing.T) {
+		bm := NewBitmap()
+		for x := uint64(0); x < 3*maxCard; x += 2 {
+			bm.Set(x)
+		}
+		bm.RemoveRange(10, 3*maxCard-100)
+		bm.Remove(3*maxCard - 50)
+		expected := bm.Clone()
+		lenBytes := bm.LenInBytes()
+
+		saved := bm.Optimize()
+
+		require.Equal(t, lenBytes-bm.LenInBytes(), saved)
+		require.Equal(t, []uint16{typeArray, typeArray}, containerTypes(bm))
+		assertMatches(t, expected, bm)
+	})
+
+	t.Run("consecutive values become runs", func(t *testing.T) {
+		bm := NewBitmap()
+		bm.FillUp(3*maxCard - 1)
+		bm.RemoveRange(100, 200)
+		bm.Set(5 * maxCard)
+		expected := bm.Clone()
+		lenBytes := bm.LenInBytes()
+
+		saved := bm.Optimize()
+
+		require.Equal(t, lenBytes-bm.LenInBytes(), saved)
+		require.Equal(t, []uint16{typeRun, typeRun, typeRun, typeArray}, containerTypes(bm))
+		assertMatches(t, expected, bm)
+		require.Equal(t, 0, bm.Optimize())
+
+		// optimized bitmap is still modifiable
+		for x := uint64(100); x < 150; x++ {
+			expected.Set(x)
+			bm.Set(x)
+		}
+		expected.Remove(maxCard + 7)
+		bm.Remove(maxCard + 7)
+		assertMatches(t, expected, bm)
+	})
+
+	t.Run("large arrays become bitmaps", func(t *testing.T) {
+		bm := NewBitmap()
+		for x := uint64(0); x < 6000; x += 2 {
+			bm.Set(x)
+		}
+		expected := bm.Clone()
+
+		bm.Optimize()
+
+		require.Equal(t, []uint16{typeBitmap}, containerTypes(bm))
+		assertMatches(t, expected, bm)
+	})
+
+	t.Run("random values stay bitmaps", func(t *testing.T) {
+		rnd := rand.New(rand.NewSource(1))
+		bm := NewBitmap()
+		for i := 0; i < 30000; i++ {
+			bm.Set(rnd.Uint64() % maxCard)
+		}
+		expected := bm.Clone()
+
+		bm.Optimize()
+
+		require.Equal(t, []uint16{typeBitmap}, containerTypes(bm))
+		assertMatches(t, expected, bm)
+	})
+
+	t.Run("optimized buffer", func(t *testing.T) {
+		bm := NewBitmap()
+		for x := uint64(0); x < 10*maxCard; x += 3 {
+			bm.Set(x)
+		}
+		bm.RemoveRange(maxCard, 9*maxCard)
+		bm.Optimize()
+
+		buf := bm.ToBuffer()
+		require.Equal(t, bm.LenInBytes(), len(buf))
+		assertMatches(t, bm, FromBuffer(buf))
+	})
+
+	t.Run("mutations after optimize", func(t *testing.T) {
+		build := map[string]func() *Bitmap{
+			"empty key 0 container": func() *Bitmap {
+				bm := NewBitmap()
+				bm.Set(1 << 20)
+				return bm
+			},
+			"full array": func() *Bitmap {
+				bm := NewBitmap()
+				for x := uint64(1); x <= 100; x += 3 {
+					bm.Set(x)
+				}
+				return bm
+			},
+			"runs": func() *Bitmap {
+				bm := NewBitmap()
+				bm.AddRange(10, 5000)
+				bm.AddRange(maxCard+100, 3*maxCard)
+				return bm
+			},
+		}
+		ops := []func(bm *Bitmap){
+			func(bm *Bitmap) { bm.RemoveRange(0, 10) },
+			func(bm *Bitmap) { bm.RemoveRange(1000, 2000) },
+			func(bm *Bitmap) { bm.RemoveRange(maxCard+200, maxCard+300) },
+			func(bm *Bitmap) { bm.RemoveRange(50, 2*maxCard) },
+			func(bm *Bitmap) { bm.Remove(4) },
+			func(bm *Bitmap) { bm.Remove(1 << 20) },
+			func(bm *Bitmap) { bm.Set(1 << 21) },
+			func(bm *Bitmap) { bm.Set(3) },
+			func(bm *Bitmap) { bm.Set(101) },
+		}
+		for name, newBitmap := range build {
+			for i, op := range ops {
+				expected := newBitmap()
+				bm := newBitmap()
+				bm.Optimize()
+				op(expected)
+				op(bm)
+				require.Equal(t, expected.ToArray(), bm.ToArray(), "%s, op %d", name, i)
+			}
+
+			// All the operations one after another.
+			expected := newBitmap()
+			bm := newBitmap()
+			bm.Optimize()
+			for _, op := range ops {
+				op(expected)
+				op(bm)
+			}
+			assertMatches(t, expected, bm)
+		}
+	})
+}
+
+func TestRangeExtraction(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	bm := NewBitmap()
+	for i := 0; i < 20_000; i++ {
+		bm.Set(rnd.Uint64() % (4 << 16))
+	}
+	bm.AddRange(5<<16, 5<<16+30_000)
+	bm.Or(toRunBitmap(runsBitmap(rnd, 20, 3000, 8<<16)))
+	bm.Set(math.MaxUint64)
+	arr := bm.ToArray()
+
+	inRange := func(lo, hi uint64) []uint64 {
+		var res []uint64
+		for _, x := range arr {
+			if x >= lo && x < hi {
+				res = append(res, x)
+			}
+		}
+		return res
+	}
+	check := func(t *testing.T, lo, hi uint64) {
+		expected := inRange(lo, hi)
+
+		var iterated []uint64
+		bm.IterateRange(lo, hi, func(x uint64) bool {
+			iterated = append(iterated, x)
+			return true
+		})
+		require.Equal(t, expected, iterated)
+		require.Equal(t, expected, bm.ToArrayRange(lo, hi))
+
+		sub := bm.SubBitmap(lo, hi)
+		require.Equal(t, len(expected), sub.GetCardinality())
+		if len(expected) > 0 {
+			require.Equal(t, expected, sub.ToArray())
+		}
+		require.Equal(t, sub.ToArray(), sub.Clone().ToArray())
+	}
+
+	t.Run("random ranges", func(t *testing.T) {
+		for i := 0; i < 200; i++ {
+			lo := rnd.Uint64() % (9 << 16)
+			hi := lo + rnd.Uint64()%(3<<16)
+			check(t, lo, hi)
+		}
+	})
+
+	t.Run("edge ranges", func(t *testing.T) {
+		check(t, 0, 1)
+		check(t, 0, 1<<16)
+		check(t, 1<<16, 2<<16)
+		check(t, 5<<16+100, 5<<16+200)
+		check(t, 0, math.MaxUint64)
+		check(t, math.MaxUint64-1, math.MaxUint64)
+		check(t, 10, 10)
+		check(t, 20, 10)
+	})
+
+	t.Run("early termination", func(t *testing.T) {
+		var n int
+		bm.IterateRange(0, math.MaxUint64, func(x uint64) bool {
+			n++
+			return n < 5
+		})
+		require.Equal(t, 5, n)
+	})
+
+	t.Run("sub bitmap is independent", func(t *testing.T) {
+		sub := bm.SubBitmap(1<<16, 6<<16)
+		expected := inRange(1<<16, 6<<16)
+		sub.Set(0)
+		sub.AddRange(10<<16, 11<<16)
+		sub.Remove(expected[0])
+		require.Equal(t, arr, bm.ToArray())
+		require.Equal(t, len(expected)+(1<<16), sub.GetCardinality())
+	})
+
+	t.Run("range past the end of full array", func(t *testing.T) {
+		// Array containers filled up to their capacity.
+		for _, n := range []int{60, 64, 1000} {
+			full := NewBitmap()
+			for i := 0; i < n; i++ {
+				full.Set(uint64(i))
+				full.Set(3<<16 + uint64(i))
+			}
+			expected := full.ToArray()
+
+			sub := full.SubBitmap(0, 1000)
+			require.Equal(t, expected[:n], sub.ToArray())
+			sub = full.SubBitmap(0, 3<<16+1000)
+			require.Equal(t, expected, sub.ToArray())
+			sub = full.SubBitmap(5, 3<<16+2000)
+			require.Equal(t, expected[5:], sub.ToArray())
+
+			sub.RemoveRange(3<<16+uint64(n), 3<<16+uint64(n)+10)
+			sub.RemoveRange(uint64(n), uint64(n)+10)
+			require.Equal(t, expected[5:], sub.ToArray())
+		}
+	})
+}
@@ -1,9 +1,11 @@
 package sroar
 
 import (
+	"bytes"
 	"fmt"
 	"math"
 	"math/rand"
+	"sort"
 	"testing"
 	"time"
 
@@ -652,6 +654,236 @@ func TestSelect(t *testing.T) {
 	}
 }
 
+func TestRankIndex(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	bm := NewBitmap()
+	for i := 0; i < 50_000; i++ {
+		bm.Set(rnd.Uint64() % (1000 << 16))
+	}
+	bm.AddRange(2000<<16, 2003<<16)
+	bm.Or(toRunBitmap(runsBitmap(rnd, 100, 1000, 3000<<16)))
+	// Leave some empty containers around.
+	bm.RemoveRange(10<<16, 11<<16)
+	bm.ZeroOut()
+	bm.Or(FromSortedList([]uint64{1, 5 << 16, 7 << 16, 12 << 16}))
+	for i := 0; i < 50_000; i++ {
+		bm.Set(rnd.Uint64() % (3000 << 16))
+	}
+
+	check := func(t *testing.T, bm *Bitmap) {
+		arr := bm.ToArray()
+		for i := 0; i < 2000; i++ {
+			idx := rnd.Intn(len(arr))
+			require.Equal(t, idx, bm.Rank(arr[idx]))
+			x, err := bm.Select(uint64(idx))
+			require.NoError(t, err)
+			require.Equal(t, arr[idx], x)
+		}
+
+		indexes := make([]uint64, 1000)
+		expected := make([]uint64, len(indexes))
+		for i := range indexes {
+			indexes[i] = uint64(rnd.Intn(len(arr)))
+			expected[i] = arr[indexes[i]]
+		}
+		vals, err := bm.SelectMany(indexes)
+		require.NoError(t, err)
+		require.Equal(t, expected, vals)
+
+		require.Equal(t, -1, bm.Rank(5000<<16))
+		_, err = bm.Select(uint64(len(arr)))
+		require.Error(t, err)
+		_, err = bm.SelectMany([]uint64{0, uint64(len(arr))})
+		require.Error(t, err)
+	}
+
+	t.Run("built lazily", func(t *testing.T) {
+		require.Nil(t, bm.rankIdx.Load())
+		check(t, bm)
+		require.NotNil(t, bm.rankIdx.Load())
+	})
+
+	t.Run("invalidated on modifications", func(t *testing.T) {
+		modifications := map[string]func(bm *Bitmap){
+			"set":          func(bm *Bitmap) { bm.Set(3 << 16) },
+			"remove":       func(bm *Bitmap) { bm.Remove(bm.Minimum()) },
+			"remove range": func(bm *Bitmap) { bm.RemoveRange(100<<16, 500<<16) },
+			"add range":    func(bm *Bitmap) { bm.AddRange(1, 5<<16) },
+			"flip":         func(bm *Bitmap) { bm.Flip(1, 5<<16) },
+			"and":          func(bm *Bitmap) { bm.And(FromSortedList([]uint64{1, 5 << 16})) },
+			"and not":      func(bm *Bitmap) { bm.AndNot(runsBitmap(rnd, 10, 1<<18, 3000<<16)) },
+			"or":           func(bm *Bitmap) { bm.Or(runsBitmap(rnd, 10, 1<<18, 3000<<16)) },
+			"xor":          func(bm *Bitmap) { bm.Xor(runsBitmap(rnd, 10, 1<<18, 3000<<16)) },
+			"fill up":      func(bm *Bitmap) { bm.FillUp(3001 << 16) },
+			"optimize":     func(bm *Bitmap) { bm.RemoveRange(0, 1000<<16); bm.Optimize() },
+		}
+		for name, modify := range modifications {
+			t.Run(name, func(t *testing.T) {
+				bm := bm.Clone()
+				check(t, bm)
+				modify(bm)
+				require.Nil(t, bm.rankIdx.Load())
+				check(t, bm)
+			})
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	mixed := NewBitmap()
+	for i := 0; i < 50_000; i++ {
+		mixed.Set(rnd.Uint64() % (20 << 16))
+	}
+	mixed.Or(FromSortedList([]uint64{1, 2, 3, 30 << 16, 31 << 16}))
+	mixed.Or(toRunBitmap(runsBitmap(rnd, 50, 5000, 40<<16)))
+	mixed.RemoveRange(5<<16, 6<<16)
+	for i := 0; i < 1000; i++ {
+		mixed.Set(50<<16 + rnd.Uint64()%(10<<16))
+	}
+
+	optimized := mixed.Clone()
+	optimized.Optimize()
+
+	t.Run("valid buffers", func(t *testing.T) {
+		for _, bm := range []*Bitmap{
+			NewBitmap(), FromSortedList([]uint64{0}), mixed, optimized, Prefill(1 << 20),
+			mixed.SubBitmap(1<<16, 10<<16), mixed.CloneToBuf(make([]byte, 2*mixed.LenInBytes())),
+		} {
+			buf := bm.ToBufferWithCopy()
+			require.NoError(t, Validate(buf))
+			safe, err := FromBufferSafe(buf)
+			require.NoError(t, err)
+			require.Equal(t, bm.GetCardinality(), safe.GetCardinality())
+			if bm.GetCardinality() > 0 {
+				require.Equal(t, bm.ToArray(), safe.ToArray())
+			}
+		}
+		require.NoError(t, Validate(nil))
+	})
+
+	// corrupt returns a buffer of the mixed bitmap modified by the given func.
+	corrupt := func(modify func(bm *Bitmap)) []byte {
+		bm := FromBufferWithCopy(mixed.ToBuffer())
+		modify(bm)
+		return toByteSlice(bm.data)
+	}
+	containerOf := func(bm *Bitmap, typ uint16) []uint16 {
+		for i := 0; i < bm.keys.numKeys(); i++ {
+			c := bm.getContainer(bm.keys.val(i))
+			if c[indexType] == typ && getCardinality(c) > 2 {
+				return c
+			}
+		}
+		panic("container not found")
+	}
+
+	invalid := map[string][]byte{
+		"odd length": mixed.ToBufferWithCopy()[:101],
+		"too short":  mixed.ToBufferWithCopy()[:6],
+		"truncated":  mixed.ToBufferWithCopy()[:mixed.LenInBytes()-2],
+		"node size": corrupt(func(bm *Bitmap) {
+			bm.keys.setNodeSize(len(bm.data) + 4)
+		}),
+		"num keys": corrupt(func(bm *Bitmap) {
+			bm.keys.setNumKeys(bm.keys.maxKeys())
+		}),
+		"first key": corrupt(func(bm *Bitmap) {
+			bm.keys.setAt(keyOffset(0), 1<<16)
+		}),
+		"key lower bits": corrupt(func(bm *Bitmap) {
+			bm.keys.setAt(keyOffset(1), bm.keys.key(1)|1)
+		}),
+		"key order": corrupt(func(bm *Bitmap) {
+			k1, k2 := bm.keys.key(1), bm.keys.key(2)
+			bm.keys.setAt(keyOffset(1), k2)
+			bm.keys.setAt(keyOffset(2), k1)
+		}),
+		"offset": corrupt(func(bm *Bitmap) {
+			bm.keys.setAt(valOffset(1), uint64(len(bm.data)))
+		}),
+		"offset in keys node": corrupt(func(bm *Bitmap) {
+			bm.keys.setAt(valOffset(1), 2)
+		}),
+		"overlapping containers": corrupt(func(bm *Bitmap) {
+			bm.keys.setAt(valOffset(2), bm.keys.val(1))
+		}),
+		"container size": corrupt(func(bm *Bitmap) {
+			containerOf(bm, typeArray)[indexSize] = math.MaxUint16
+		}),
+		"container type": corrupt(func(bm *Bitmap) {
+			containerOf(bm, typeArray)[indexType] = 7
+		}),
+		"array cardinality": corrupt(func(bm *Bitmap) {
+			c := containerOf(bm, typeArray)
+			setCardinality(c, len(c))
+		}),
+		"array order": corrupt(func(bm *Bitmap) {
+			c := containerOf(bm, typeArray)
+			c[startIdx], c[startIdx+1] = c[startIdx+1], c[startIdx]
+		}),
+		"bitmap cardinality": corrupt(func(bm *Bitmap) {
+			c := containerOf(bm, typeBitmap)
+			setCardinality(c, getCardinality(c)+1)
+		}),
+		"bitmap size": corrupt(func(bm *Bitmap) {
+			containerOf(bm, typeBitmap)[indexSize] = 64
+		}),
+		"run cardinality": corrupt(func(bm *Bitmap) {
+			c := containerOf(bm, typeRun)
+			setCardinality(c, getCardinality(c)-1)
+		}),
+		"run order": corrupt(func(bm *Bitmap) {
+			r := run(containerOf(bm, typeRun))
+			r.setRun(0, r.last(0), r.start(0)-1)
+		}),
+		"adjacent runs": corrupt(func(bm *Bitmap) {
+			var r run
+			for i := 0; i < bm.keys.numKeys() && r == nil; i++ {
+				c := bm.getContainer(bm.keys.val(i))
+				if c[indexType] == typeRun && run(c).numRuns() >= 2 {
+					r = run(c)
+				}
+			}
+			require.NotNil(t, r)
+			setCardinality(r, getCardinality(r)+int(r.start(1)-1-r.last(0)))
+			r.setRun(0, r.start(0), r.start(1)-1)
+		}),
+		"number of runs": corrupt(func(bm *Bitmap) {
+			r := run(containerOf(bm, typeRun))
+			r.setNumRuns(len(r))
+		}),
+	}
+	for name, buf := range invalid {
+		t.Run(name, func(t *testing.T) {
+			err := Validate(buf)
+			require.Error(t, err)
+			require.ErrorIs(t, err, ErrInvalidBuffer)
+			_, err = FromBufferSafe(buf)
+			require.Error(t, err)
+		})
+	}
+
+	t.Run("random corruptions", func(t *testing.T) {
+		src := mixed.ToBufferWithCopy()
+		for i := 0; i < 1000; i++ {
+			buf := append([]byte(nil), src...)
+			for j := rnd.Intn(4); j >= 0; j-- {
+				buf[rnd.Intn(len(buf))] = byte(rnd.Intn(256))
+			}
+			bm, err := FromBufferSafe(buf)
+			if err != nil {
+				continue
+			}
+			// Whatever passes validation has to be readable.
+			bm.GetCardinality()
+			bm.ToArray()
+			bm.Contains(rnd.Uint64() % (40 << 16))
+			bm.Clone().Set(rnd.Uint64() % (40 << 16))
+		}
+	})
+}
+
 func TestClone(t *testing.T) {
 	a := NewBitmap()
 	N := int(1e5)
@@ -722,6 +954,94 @@ func TestExtremes(t *testing.T) {
 	require.Equal(t, uint64(maxContainerSize), a.Maximum())
 }
 
+func TestExtremesOK(t *testing.T) {
+	a := NewBitmap()
+	_, ok := a.MinimumOK()
+	require.False(t, ok)
+	_, ok = a.MaximumOK()
+	require.False(t, ok)
+
+	a.Set(0)
+	x, ok := a.MinimumOK()
+	require.True(t, ok)
+	require.Equal(t, uint64(0), x)
+	x, ok = a.MaximumOK()
+	require.True(t, ok)
+	require.Equal(t, uint64(0), x)
+
+	a.Set(5 << 16)
+	a.Remove(0)
+	x, ok = a.MinimumOK()
+	require.True(t, ok)
+	require.Equal(t, uint64(5<<16), x)
+
+	a.Remove(5 << 16)
+	_, ok = a.MinimumOK()
+	require.False(t, ok)
+	_, ok = a.MaximumOK()
+	require.False(t, ok)
+}
+
+func TestNextPreviousValue(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	sparse := NewBitmap()
+	dense := NewBitmap()
+	for i := 0; i < 50_000; i++ {
+		x := rnd.Uint64() % (8 << 16)
+		dense.Set(x)
+		if i%100 == 0 {
+			sparse.Set(x)
+		}
+	}
+	runs := toRunBitmap(runsBitmap(rnd, 50, 5000, 8<<16))
+	mixed := Or(Or(sparse, runs), dense.SubBitmap(3<<16, 5<<16))
+	// Leave an empty container in between.
+	mixed.Set(10<<16 + 5)
+	mixed.Set(12 << 16)
+	mixed.Remove(10<<16 + 5)
+	mixed.Set(math.MaxUint64)
+
+	for name, bm := range map[string]*Bitmap{
+		"arrays":  sparse,
+		"bitmaps": dense,
+		"runs":    runs,
+		"mixed":   mixed,
+		"empty":   NewBitmap(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			arr := bm.ToArray()
+			check := func(x uint64) {
+				i := sort.Search(len(arr), func(i int) bool { return arr[i] >= x })
+				next, ok := bm.NextValue(x)
+				require.Equalf(t, i < len(arr), ok, "next of %d", x)
+				if ok {
+					require.Equalf(t, arr[i], next, "next of %d", x)
+				}
+
+				i = sort.Search(len(arr), func(i int) bool { return arr[i] > x }) - 1
+				prev, ok := bm.PreviousValue(x)
+				require.Equalf(t, i >= 0, ok, "previous of %d", x)
+				if ok {
+					require.Equalf(t, arr[i], prev, "previous of %d", x)
+				}
+			}
+
+			for i := 0; i < 2000; i++ {
+				check(rnd.Uint64() % (13 << 16))
+			}
+			for i := 0; i < 500 && len(arr) > 0; i++ {
+				x := arr[rnd.Intn(len(arr))]
+				check(x)
+				check(x - 1)
+				check(x + 1)
+			}
+			for _, x := range []uint64{0, 1<<16 - 1, 1 << 16, 10 << 16, 11 << 16, math.MaxUint64} {
+				check(x)
+			}
+		})
+	}
+}
+
 func TestCleanup(t *testing.T) {
 	a := NewBitmap()
 	n := 10
@@ -849,6 +1169,60 @@ func TestRank(t *testing.T) {
 	}
 }
 
+func TestCountRange(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	sparse := NewBitmap()
+	dense := NewBitmap()
+	for i := 0; i < 100_000; i++ {
+		x := rnd.Uint64() % (8 << 16)
+		dense.Set(x)
+		if i%100 == 0 {
+			sparse.Set(x)
+		}
+	}
+	runs := toRunBitmap(runsBitmap(rnd, 50, 5000, 8<<16))
+	mixed := Or(Or(sparse, runs), dense.SubBitmap(3<<16, 5<<16))
+	mixed.Set(math.MaxUint64)
+
+	for name, bm := range map[string]*Bitmap{
+		"arrays":  sparse,
+		"bitmaps": dense,
+		"runs":    runs,
+		"mixed":   mixed,
+		"empty":   NewBitmap(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			arr := bm.ToArray()
+			count := func(lo, hi uint64) int {
+				var n int
+				for _, x := range arr {
+					if x >= lo && x < hi {
+						n++
+					}
+				}
+				return n
+			}
+			for i := 0; i < 200; i++ {
+				lo := rnd.Uint64() % (9 << 16)
+				hi := lo + rnd.Uint64()%(3<<16)
+				require.Equalf(t, count(lo, hi), bm.CountRange(lo, hi), "range [%d, %d)", lo, hi)
+			}
+			for _, r := range [][2]uint64{
+				{0, 1}, {0, 1 << 16}, {1 << 16, 2 << 16}, {1<<16 - 1, 1<<16 + 1},
+				{0, math.MaxUint64}, {math.MaxUint64 - 1, math.MaxUint64}, {10, 10}, {20, 10},
+			} {
+				require.Equalf(t, count(r[0], r[1]), bm.CountRange(r[0], r[1]), "range [%d, %d)", r[0], r[1])
+			}
+
+			card := bm.GetCardinality()
+			if bm.Contains(math.MaxUint64) {
+				card--
+			}
+			require.Equal(t, card, bm.CountRange(0, math.MaxUint64))
+		})
+	}
+}
+
 func TestSplit(t *testing.T) {
 	run := func(n int) {
 		r := NewBitmap()
@@ -881,6 +1255,25 @@ func TestSplit(t *testing.T) {
 	run(1e6)
 }
 
+func TestSplitWithZero(t *testing.T) {
+	n := 5000
+	r := NewBitmap()
+	for i := 0; i < n; i++ {
+		r.Set(uint64(i))
+	}
+	f := func(start, end uint64) uint64 { return end - start + 1 }
+
+	// External size exceeds maxSz, so the only container is split further element by element.
+	bms := r.Split(f, 1<<10)
+	require.Greater(t, len(bms), 1)
+
+	var all []uint64
+	for _, bm := range bms {
+		all = append(all, bm.ToArray()...)
+	}
+	require.Equal(t, r.ToArray(), all)
+}
+
 // Test making sure out of range panic does not occur anymore
 // https://github.com/weaviate/sroar/issues/1
 //
@@ -1214,3 +1607,105 @@ func TestZeroOut(t *testing.T) {
 		require.Equal(t, bmTemplate.capInBytes(), bm.capInBytes())
 	})
 }
+
+// readOnlyMutators lists methods modifying the bitmap, all of them have to panic on read-only
+// bitmaps.
+var readOnlyMutators = map[string]func(bm *Bitmap){
+	"Set":                       func(bm *Bitmap) { bm.Set(1 << 40) },
+	"SetMany":                   func(bm *Bitmap) { bm.SetMany([]uint64{1, 2, 3}) },
+	"Remove":                    func(bm *Bitmap) { bm.Remove(bm.Minimum()) },
+	"RemoveRange":               func(bm *Bitmap) { bm.RemoveRange(0, 1<<20) },
+	"AddRange":                  func(bm *Bitmap) { bm.AddRange(0, 1<<20) },
+	"Flip":                      func(bm *Bitmap) { bm.Flip(0, 1<<20) },
+	"And":                       func(bm *Bitmap) { bm.And(FromSortedList([]uint64{1})) },
+	"AndConc":                   func(bm *Bitmap) { bm.AndConc(FromSortedList([]uint64{1}), 2) },
+	"AndNot":                    func(bm *Bitmap) { bm.AndNot(FromSortedList([]uint64{1})) },
+	"AndNotConc":                func(bm *Bitmap) { bm.AndNotConc(FromSortedList([]uint64{1}), 2) },
+	"Or":                        func(bm *Bitmap) { bm.Or(FromSortedList([]uint64{1})) },
+	"OrConc":                    func(bm *Bitmap) { bm.OrConc(FromSortedList([]uint64{1}), 2) },
+	"Xor":                       func(bm *Bitmap) { bm.Xor(FromSortedList([]uint64{1})) },
+	"XorConc":                   func(bm *Bitmap) { bm.XorConc(FromSortedList([]uint64{1}), 2) },
+	"AndOld":                    func(bm *Bitmap) { bm.AndOld(FromSortedList([]uint64{1})) },
+	"AndNotOld":                 func(bm *Bitmap) { bm.AndNotOld(FromSortedList([]uint64{1})) },
+	"OrOld":                     func(bm *Bitmap) { bm.OrOld(FromSortedList([]uint64{1})) },
+	"FillUp":                    func(bm *Bitmap) { bm.FillUp(1 << 30) },
+	"Cleanup":                   func(bm *Bitmap) { bm.Cleanup() },
+	"ZeroOut":                   func(bm *Bitmap) { bm.ZeroOut() },
+	"Reset":                     func(bm *Bitmap) { bm.Reset() },
+	"Optimize":                  func(bm *Bitmap) { bm.Optimize() },
+	"ConvertToBitmapContainers": func(bm *Bitmap) { bm.ConvertToBitmapContainers() },
+	"ReadFrom": func(bm *Bitmap) {
+		bm.ReadFrom(bytes.NewReader(NewBitmap().ToBufferFramed()))
+	},
+	"UnmarshalBinary": func(bm *Bitmap) { bm.UnmarshalBinary(NewBitmap().ToBufferFramed()) },
+}
+
+func TestReadOnlyBuffer(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	src := NewBitmap()
+	for i := 0; i < 20_000; i++ {
+		src.Set(rnd.Uint64() % (20 << 16))
+	}
+	src.Or(toRunBitmap(runsBitmap(rnd, 50, 5000, 40<<16)))
+	arr := src.ToArray()
+	buf := src.ToBuffer()
+	orig := append([]byte(nil), buf...)
+
+	t.Run("mutators panic", func(t *testing.T) {
+		bm := FromBuffer(buf)
+		require.True(t, bm.IsReadOnly())
+		for name, mutate := range readOnlyMutators {
+			require.PanicsWithValuef(t, ErrReadOnly, func() { mutate(bm) }, "method %s", name)
+		}
+		require.Equal(t, arr, bm.ToArray())
+		require.Equal(t, orig, buf)
+
+		empty := FromBuffer(nil)
+		require.True(t, empty.IsReadOnly())
+		require.PanicsWithValue(t, ErrReadOnly, func() { empty.Set(1) })
+	})
+
+	t.Run("make writable", func(t *testing.T) {
+		bm := FromBuffer(buf)
+		bm.MakeWritable()
+		require.False(t, bm.IsReadOnly())
+		bm.Set(1 << 40)
+		bm.RemoveRange(0, 10<<16)
+		require.Equal(t, orig, buf)
+		require.Equal(t, arr, FromBuffer(buf).ToArray())
+		require.True(t, bm.Contains(1<<40))
+		require.Equal(t, 0, bm.CountRange(0, 10<<16))
+
+		// No-op for writable bitmaps.
+		bm.MakeWritable()
+		require.True(t, bm.Contains(1<<40))
+	})
+
+	t.Run("thaw", func(t *testing.T) {
+		for name, mutate := range readOnlyMutators {
+			bm := FromBuffer(buf)
+			bm.Thaw()
+			require.False(t, bm.IsReadOnly())
+			// Reads use the buffer until the first modification.
+			require.Equal(t, arr, bm.ToArray())
+
+			expected := src.Clone()
+			mutate(expected)
+			mutate(bm)
+			require.Truef(t, expected.Equals(bm), "method %s", name)
+			require.Equalf(t, orig, buf, "method %s", name)
+		}
+	})
+
+	t.Run("clones are writable", func(t *testing.T) {
+		bm := FromBuffer(buf)
+		clone := bm.Clone()
+		require.False(t, clone.IsReadOnly())
+		clone.Set(1 << 40)
+
+		clone = bm.CloneToBuf(make([]byte, len(buf)*2))
+		require.False(t, clone.IsReadOnly())
+		clone.Set(1 << 40)
+		require.Equal(t, orig, buf)
+	})
+}
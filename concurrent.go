@@ -0,0 +1,325 @@
+package sroar
+
+import (
+	"iter"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ConcurrentBitmap is a bitmap safe for concurrent use, which allows taking immutable snapshots
+// in O(1). Each container is kept in its own slice, so after a snapshot is taken writers copy
+// only the list of containers and the containers they modify, instead of the whole bitmap.
+// Long running reads should use a snapshot, so they do not block writers.
+type ConcurrentBitmap struct {
+	mu    sync.RWMutex
+	state *cowState
+}
+
+// cowState holds the containers of ConcurrentBitmap. Once frozen, the state is shared with
+// snapshots and it is never modified again.
+type cowState struct {
+	// keys are sorted keys of the containers, containers[i] holds the elements having key
+	// keys[i]. Containers are never empty and they have no space after them, so their size is
+	// always their length.
+	keys       []uint64
+	containers [][]uint16
+	// owned[i] is false if containers[i] is shared with a frozen state, it has to be copied
+	// before being modified.
+	owned  []bool
+	frozen atomic.Bool
+}
+
+func NewConcurrentBitmap() *ConcurrentBitmap {
+	return &ConcurrentBitmap{state: &cowState{}}
+}
+
+// NewConcurrentBitmapFrom returns a ConcurrentBitmap with the elements of bm. The containers of
+// bm are copied, bm is not modified and it can still be used.
+func NewConcurrentBitmapFrom(bm *Bitmap) *ConcurrentBitmap {
+	st := &cowState{}
+	if bm == nil {
+		return &ConcurrentBitmap{state: st}
+	}
+	n := bm.keys.numKeys()
+	for i := 0; i < n; i++ {
+		c := bm.getContainer(bm.keys.val(i))
+		if getCardinality(c) == 0 {
+			continue
+		}
+		st.keys = append(st.keys, bm.keys.key(i))
+		st.containers = append(st.containers, slices.Clone(c))
+		st.owned = append(st.owned, true)
+	}
+	return &ConcurrentBitmap{state: st}
+}
+
+// writable returns the state writers can modify, copying the frozen one. Write lock has to
+// be held.
+func (cb *ConcurrentBitmap) writable() *cowState {
+	st := cb.state
+	if !st.frozen.Load() {
+		return st
+	}
+	n := len(st.keys)
+	cp := &cowState{
+		keys:       make([]uint64, n, n+1),
+		containers: make([][]uint16, n, n+1),
+		owned:      make([]bool, n, n+1),
+	}
+	copy(cp.keys, st.keys)
+	copy(cp.containers, st.containers)
+	cb.state = cp
+	return cp
+}
+
+// find returns the index of the container for the given key, and whether it exists.
+func (st *cowState) find(key uint64) (int, bool) {
+	i := sort.Search(len(st.keys), func(i int) bool { return st.keys[i] >= key })
+	return i, i < len(st.keys) && st.keys[i] == key
+}
+
+// container returns the index of the container for the given key, which can be modified. If
+// create is set, missing container is created, otherwise false is returned for it.
+func (st *cowState) container(key uint64, create bool) (int, bool) {
+	i, has := st.find(key)
+	if !has {
+		if !create {
+			return i, false
+		}
+		c := make([]uint16, minContainerSize)
+		c[indexSize] = minContainerSize
+		c[indexType] = typeArray
+
+		st.keys = append(st.keys, 0)
+		st.containers = append(st.containers, nil)
+		st.owned = append(st.owned, false)
+		copy(st.keys[i+1:], st.keys[i:])
+		copy(st.containers[i+1:], st.containers[i:])
+		copy(st.owned[i+1:], st.owned[i:])
+		st.keys[i], st.containers[i], st.owned[i] = key, c, true
+	}
+	if !st.owned[i] {
+		st.containers[i], st.owned[i] = slices.Clone(st.containers[i]), true
+	}
+	return i, true
+}
+
+// growAt makes space for another element or run in the container at index i, just like
+// Bitmap.expandContainer. The container has to be owned.
+func (st *cowState) growAt(i int) {
+	c := st.containers[i]
+	if len(c) < 2048 {
+		out := make([]uint16, 2*len(c))
+		copy(out, c)
+		out[indexSize] = uint16(len(out))
+		st.containers[i] = out
+		return
+	}
+	switch c[indexType] {
+	case typeArray:
+		st.containers[i] = array(c).toBitmapContainer(nil)
+	case typeRun:
+		st.containers[i] = run(c).toBitmapContainer(nil)
+	default:
+		panic("Only array and run containers can be expanded")
+	}
+}
+
+func (st *cowState) removeAt(i int) {
+	st.keys = append(st.keys[:i], st.keys[i+1:]...)
+	st.containers = append(st.containers[:i], st.containers[i+1:]...)
+	st.owned = append(st.owned[:i], st.owned[i+1:]...)
+}
+
+// Set adds x to the bitmap. It returns true if x was not in the bitmap before.
+func (cb *ConcurrentBitmap) Set(x uint64) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	st := cb.writable()
+	i, _ := st.container(x&mask, true)
+	if isFullContainer(st.containers[i]) {
+		st.growAt(i)
+	}
+
+	c := st.containers[i]
+	switch c[indexType] {
+	case typeArray:
+		return array(c).add(uint16(x))
+	case typeBitmap:
+		return bitmap(c).add(uint16(x))
+	case typeRun:
+		return run(c).add(uint16(x))
+	}
+	panic("we shouldn't reach here")
+}
+
+// Remove removes x from the bitmap. It returns true if x was in the bitmap before.
+func (cb *ConcurrentBitmap) Remove(x uint64) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if !cb.state.contains(x) {
+		// Do not copy the frozen state for nothing.
+		return false
+	}
+	st := cb.writable()
+	i, _ := st.container(x&mask, false)
+	if c := st.containers[i]; c[indexType] == typeRun && run(c).isFull() {
+		// Removing x might split a run in two. Make space for it first.
+		st.growAt(i)
+	}
+
+	c := st.containers[i]
+	switch c[indexType] {
+	case typeArray:
+		array(c).remove(uint16(x))
+	case typeBitmap:
+		bitmap(c).remove(uint16(x))
+	case typeRun:
+		run(c).remove(uint16(x))
+	}
+	if getCardinality(c) == 0 {
+		st.removeAt(i)
+	}
+	return true
+}
+
+func (cb *ConcurrentBitmap) Contains(x uint64) bool {
+	cb.mu.RLock()
+	defer cb.mu.RUnlock()
+	return cb.state.contains(x)
+}
+
+func (cb *ConcurrentBitmap) GetCardinality() int {
+	cb.mu.RLock()
+	defer cb.mu.RUnlock()
+	return cb.state.cardinality()
+}
+
+// Snapshot returns an immutable view of the bitmap in O(1). The snapshot is not affected by
+// later modifications of the bitmap and it can be read concurrently with them.
+func (cb *ConcurrentBitmap) Snapshot() *BitmapSnapshot {
+	cb.mu.RLock()
+	defer cb.mu.RUnlock()
+	cb.state.frozen.Store(true)
+	return &BitmapSnapshot{state: cb.state}
+}
+
+// BitmapSnapshot is an immutable view of ConcurrentBitmap returned by Snapshot. It is safe for
+// concurrent use.
+type BitmapSnapshot struct {
+	state *cowState
+}
+
+func (s *BitmapSnapshot) Contains(x uint64) bool {
+	return s.state.contains(x)
+}
+
+func (s *BitmapSnapshot) GetCardinality() int {
+	return s.state.cardinality()
+}
+
+func (s *BitmapSnapshot) IsEmpty() bool {
+	return len(s.state.keys) == 0
+}
+
+// All returns an iterator over the elements of the snapshot in ascending order.
+func (s *BitmapSnapshot) All() iter.Seq[uint64] {
+	return func(yield func(uint64) bool) {
+		for i, key := range s.state.keys {
+			if !iterateContainer(key, s.state.containers[i], 0, yield) {
+				return
+			}
+		}
+	}
+}
+
+// IterateRange calls fn for every element in the range [lo, hi) in ascending order.
+// The iteration stops early, if fn returns false.
+func (s *BitmapSnapshot) IterateRange(lo, hi uint64, fn func(x uint64) bool) {
+	if lo >= hi {
+		return
+	}
+	st := s.state
+	inRange := func(x uint64) bool { return x < hi && fn(x) }
+	for i, _ := st.find(lo & mask); i < len(st.keys) && st.keys[i] < hi; i++ {
+		var y uint16
+		if st.keys[i] < lo {
+			y = uint16(lo)
+		}
+		if !iterateContainer(st.keys[i], st.containers[i], y, inRange) {
+			return
+		}
+	}
+}
+
+// iterateContainer calls fn for the elements of the container c having the given key, starting
+// from key | y. It returns false if fn stopped the iteration.
+func iterateContainer(key uint64, c []uint16, y uint16, fn func(x uint64) bool) bool {
+	for {
+		v, ok := nextValue(c, y)
+		if !ok {
+			return true
+		}
+		if !fn(key | uint64(v)) {
+			return false
+		}
+		if v == 0xFFFF {
+			return true
+		}
+		y = v + 1
+	}
+}
+
+func (s *BitmapSnapshot) ToArray() []uint64 {
+	res := make([]uint64, 0, s.GetCardinality())
+	for x := range s.All() {
+		res = append(res, x)
+	}
+	return res
+}
+
+// ToBitmap returns a new bitmap with the elements of the snapshot.
+func (s *BitmapSnapshot) ToBitmap() *Bitmap {
+	// Container for key = 0 is always present.
+	keys := []uint64{0}
+	containers := [][]uint16{{uint16(startIdx), typeArray, 0, 0}}
+	sizeContainers := int(startIdx)
+	for i, key := range s.state.keys {
+		c := s.state.containers[i]
+		if key == 0 {
+			containers[0] = c
+			sizeContainers = len(c)
+			continue
+		}
+		keys = append(keys, key)
+		containers = append(containers, c)
+		sizeContainers += len(c)
+	}
+	return fromContainers(keys, containers, sizeContainers)
+}
+
+func (st *cowState) contains(x uint64) bool {
+	i, has := st.find(x & mask)
+	if !has {
+		return false
+	}
+	switch c := st.containers[i]; c[indexType] {
+	case typeArray:
+		return array(c).has(uint16(x))
+	case typeBitmap:
+		return bitmap(c).has(uint16(x))
+	case typeRun:
+		return run(c).has(uint16(x))
+	}
+	return false
+}
+
+func (st *cowState) cardinality() int {
+	var card int
+	for _, c := range st.containers {
+		card += getCardinality(c)
+	}
+	return card
+}
@@ -0,0 +1,183 @@
+package sroar
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrentBitmap(t *testing.T) {
+	t.Run("matches bitmap", func(t *testing.T) {
+		rnd := rand.New(rand.NewSource(1))
+		cb := NewConcurrentBitmap()
+		bm := NewBitmap()
+		for i := 0; i < 100_000; i++ {
+			x := rnd.Uint64() % (50 << 16)
+			if i%100 == 0 {
+				x = rnd.Uint64()
+			}
+			if i%3 == 2 {
+				require.Equal(t, bm.Remove(x), cb.Remove(x))
+				continue
+			}
+			require.Equal(t, bm.Set(x), cb.Set(x))
+		}
+		require.Equal(t, bm.GetCardinality(), cb.GetCardinality())
+		for i := 0; i < 1000; i++ {
+			x := rnd.Uint64() % (50 << 16)
+			require.Equal(t, bm.Contains(x), cb.Contains(x))
+		}
+
+		snap := cb.Snapshot()
+		require.Equal(t, bm.ToArray(), snap.ToArray())
+		require.True(t, bm.Equals(snap.ToBitmap()))
+		require.Equal(t, bm.GetCardinality(), snap.GetCardinality())
+
+		for _, r := range [][2]uint64{{0, 1 << 63}, {5, 5}, {12345, 3<<16 + 7}, {49 << 16, 1 << 40}} {
+			var expected, actual []uint64
+			bm.IterateRange(r[0], r[1], func(x uint64) bool {
+				expected = append(expected, x)
+				return true
+			})
+			snap.IterateRange(r[0], r[1], func(x uint64) bool {
+				actual = append(actual, x)
+				return true
+			})
+			require.Equal(t, expected, actual, "range [%d, %d)", r[0], r[1])
+		}
+		var count int
+		snap.IterateRange(0, 1<<63, func(uint64) bool {
+			count++
+			return count < 10
+		})
+		require.Equal(t, 10, count)
+	})
+
+	t.Run("snapshots are immutable", func(t *testing.T) {
+		cb := NewConcurrentBitmap()
+		for i := uint64(0); i < 10; i++ {
+			cb.Set(i << 16)
+		}
+		empty := NewConcurrentBitmap().Snapshot()
+		snap := cb.Snapshot()
+		first := snap.ToArray()
+
+		require.True(t, cb.Set(1))
+		require.True(t, cb.Remove(2<<16))
+		require.False(t, cb.Remove(2<<16))
+		require.True(t, cb.Set(1<<40))
+
+		require.Equal(t, first, snap.ToArray())
+		require.False(t, snap.Contains(1))
+		require.True(t, snap.Contains(2<<16))
+		require.Equal(t, 10, snap.GetCardinality())
+		require.Equal(t, 11, cb.GetCardinality())
+		require.True(t, empty.IsEmpty())
+		require.True(t, empty.ToBitmap().IsEmpty())
+
+		// Only the modified containers are copied.
+		next := cb.Snapshot()
+		require.NotSame(t, &snap.state.containers[0][0], &next.state.containers[0][0])
+		require.Same(t, &snap.state.containers[3][0], &next.state.containers[2][0])
+		require.Len(t, next.state.containers, 10)
+	})
+
+	t.Run("from bitmap", func(t *testing.T) {
+		bm := NewBitmap()
+		bm.AddRange(10, 3<<16)
+		bm.Optimize()
+		for x := uint64(5 << 16); x < 6<<16; x += 3 {
+			bm.Set(x)
+		}
+		bm.Set(1 << 40)
+		bm.Remove(1 << 40)
+		orig := bm.Clone()
+		cb := NewConcurrentBitmapFrom(bm)
+		require.Equal(t, bm.ToArray(), cb.Snapshot().ToArray())
+
+		// Run containers are split and array containers grow into bitmaps.
+		for x := uint64(100); x < 1<<17; x += 5 {
+			require.Equal(t, bm.Remove(x), cb.Remove(x))
+		}
+		for x := uint64(7 << 16); x < 7<<16+5000; x++ {
+			require.Equal(t, bm.Set(x), cb.Set(x))
+		}
+		require.Equal(t, bm.ToArray(), cb.Snapshot().ToArray())
+		require.True(t, bm.Equals(cb.Snapshot().ToBitmap()))
+
+		cb = NewConcurrentBitmapFrom(orig)
+		cb.Set(1)
+		cb.Remove(100)
+		require.False(t, orig.Contains(1))
+		require.True(t, orig.Contains(100))
+		require.True(t, NewConcurrentBitmapFrom(nil).Snapshot().IsEmpty())
+		require.True(t, NewConcurrentBitmapFrom(NewBitmap()).Snapshot().IsEmpty())
+	})
+
+	t.Run("bitmap of snapshot is writable", func(t *testing.T) {
+		cb := NewConcurrentBitmap()
+		cb.Set(1 << 20)
+		for x := uint64(1); x <= 100; x += 3 {
+			cb.Set(x)
+		}
+		snap := cb.Snapshot()
+		bm := snap.ToBitmap()
+		expected := snap.ToArray()
+
+		bm.RemoveRange(0, 10)
+		bm.RemoveRange(1000, 2000)
+		bm.Remove(1 << 20)
+		bm.Set(1 << 21)
+		bm.Set(3)
+		mutated := append([]uint64{3}, expected[3:len(expected)-1]...)
+		require.Equal(t, append(mutated, 1<<21), bm.ToArray())
+		require.Equal(t, expected, snap.ToArray())
+
+		bm = NewConcurrentBitmap().Snapshot().ToBitmap()
+		bm.RemoveRange(0, 10)
+		bm.Set(5)
+		require.Equal(t, []uint64{5}, bm.ToArray())
+	})
+
+	t.Run("concurrent readers and writers", func(t *testing.T) {
+		cb := NewConcurrentBitmap()
+		for i := uint64(0); i < 20_000; i++ {
+			cb.Set(i * 7)
+		}
+
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 20; i++ {
+					snap := cb.Snapshot()
+					card := snap.GetCardinality()
+					var count int
+					for x := range snap.All() {
+						require.True(t, snap.Contains(x))
+						count++
+					}
+					require.Equal(t, card, count)
+				}
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(1))
+			for i := 0; i < 20_000; i++ {
+				x := rnd.Uint64() % (140_000)
+				if i%2 == 0 {
+					cb.Set(x)
+				} else {
+					cb.Remove(x)
+				}
+				cb.Contains(x)
+			}
+		}()
+		wg.Wait()
+	})
+}
@@ -32,6 +32,7 @@ import (
 const (
 	typeArray  uint16 = 0x00
 	typeBitmap uint16 = 0x01
+	typeRun    uint16 = 0x02
 
 	// Container header.
 	indexSize        int = 0
@@ -84,6 +85,8 @@ func zeroOutContainer(c []uint16) {
 		array(c).zeroOut()
 	case typeBitmap:
 		bitmap(c).zeroOut()
+	case typeRun:
+		run(c).zeroOut()
 	}
 }
 
@@ -93,9 +96,77 @@ func removeRangeContainer(c []uint16, lo, hi uint16) {
 		array(c).removeRange(lo, hi)
 	case typeBitmap:
 		bitmap(c).removeRange(lo, hi)
+	case typeRun:
+		run(c).removeRange(lo, hi)
 	}
 }
 
+// rangeCardinality returns the number of elements in [start, last] in the container.
+func rangeCardinality(c []uint16, start, last uint16) int {
+	if start == 0 && last == math.MaxUint16 {
+		return getCardinality(c)
+	}
+	switch c[indexType] {
+	case typeArray:
+		return array(c).rangeCardinality(start, last)
+	case typeBitmap:
+		return bitmap(c).rangeCardinality(start, last)
+	case typeRun:
+		return run(c).rangeCardinality(start, last)
+	}
+	return 0
+}
+
+func minimum(c []uint16) uint16 {
+	switch c[indexType] {
+	case typeArray:
+		return array(c).minimum()
+	case typeBitmap:
+		return bitmap(c).minimum()
+	case typeRun:
+		return run(c).minimum()
+	}
+	panic("We don't support this type of container")
+}
+
+func maximum(c []uint16) uint16 {
+	switch c[indexType] {
+	case typeArray:
+		return array(c).maximum()
+	case typeBitmap:
+		return bitmap(c).maximum()
+	case typeRun:
+		return run(c).maximum()
+	}
+	panic("We don't support this type of container")
+}
+
+// nextValue returns the smallest element >= y in the container.
+func nextValue(c []uint16, y uint16) (uint16, bool) {
+	switch c[indexType] {
+	case typeArray:
+		return array(c).nextValue(y)
+	case typeBitmap:
+		return bitmap(c).nextValue(y)
+	case typeRun:
+		return run(c).nextValue(y)
+	}
+	return 0, false
+}
+
+// previousValue returns the largest element <= y in the container.
+func previousValue(c []uint16, y uint16) (uint16, bool) {
+	switch c[indexType] {
+	case typeArray:
+		return array(c).previousValue(y)
+	case typeBitmap:
+		return bitmap(c).previousValue(y)
+	case typeRun:
+		return run(c).previousValue(y)
+	}
+	return 0, false
+}
+
 func calculateAndSetCardinality(data []uint16) {
 	if data[indexType] != typeBitmap {
 		panic("Non-bitmap containers should always have cardinality set correctly")
@@ -107,6 +178,14 @@ func calculateAndSetCardinality(data []uint16) {
 
 type array []uint16
 
+func (c array) rangeCardinality(start, last uint16) int {
+	hi := getCardinality(c)
+	if last < math.MaxUint16 {
+		hi = c.find(last + 1)
+	}
+	return hi - c.find(start)
+}
+
 // find returns the index of the first element >= x.
 // The index is based on data portion of the container, ignoring startIdx.
 // If the element > than all elements present, then N is returned where N = cardinality of the
@@ -197,11 +276,11 @@ func (c array) removeRange(lo, hi uint16) {
 	hiIdx := c.find(hi)
 
 	st := int(startIdx)
-	loVal := c[st+loIdx]
 	N := getCardinality(c)
 
-	// remove range doesn't intersect with any element in the array.
-	if hi < loVal || loIdx == N {
+	// remove range doesn't intersect with any element in the array. Container might have no
+	// space beyond its last element, so loIdx has to be checked before reading the value.
+	if loIdx == N || hi < c[st+loIdx] {
 		return
 	}
 	if hiIdx == N {
@@ -344,6 +423,24 @@ func (c array) maximum() uint16 {
 	return c[int(startIdx)+N-1]
 }
 
+func (c array) nextValue(y uint16) (uint16, bool) {
+	if i := c.find(y); i < getCardinality(c) {
+		return c[int(startIdx)+i], true
+	}
+	return 0, false
+}
+
+func (c array) previousValue(y uint16) (uint16, bool) {
+	i := c.find(y)
+	if i < getCardinality(c) && c[int(startIdx)+i] == y {
+		return y, true
+	}
+	if i > 0 {
+		return c[int(startIdx)+i-1], true
+	}
+	return 0, false
+}
+
 func (c array) toBitmapContainer(buf []uint16) []uint16 {
 	if len(buf) == 0 {
 		buf = make([]uint16, maxContainerSize)
@@ -675,6 +772,36 @@ func (b bitmap) maximum() uint16 {
 	panic("We shouldn't reach here")
 }
 
+func (b bitmap) nextValue(y uint16) (uint16, bool) {
+	data := b[startIdx:]
+	idx := int(y >> 4)
+	// Bits are ordered from the most significant one, so keep bits at positions >= y%16.
+	if w := data[idx] & (math.MaxUint16 >> (y & 0xF)); w != 0 {
+		return uint16(16*idx + bits.LeadingZeros16(w)), true
+	}
+	for idx++; idx < len(data); idx++ {
+		if w := data[idx]; w != 0 {
+			return uint16(16*idx + bits.LeadingZeros16(w)), true
+		}
+	}
+	return 0, false
+}
+
+func (b bitmap) previousValue(y uint16) (uint16, bool) {
+	data := b[startIdx:]
+	idx := int(y >> 4)
+	// Keep bits at positions <= y%16.
+	if w := data[idx] & (math.MaxUint16 << (15 - y&0xF)); w != 0 {
+		return uint16(16*idx + 15 - bits.TrailingZeros16(w)), true
+	}
+	for idx--; idx >= 0; idx-- {
+		if w := data[idx]; w != 0 {
+			return uint16(16*idx + 15 - bits.TrailingZeros16(w)), true
+		}
+	}
+	return 0, false
+}
+
 func (b bitmap) cardinality() int {
 	var num int
 	for _, x := range b[startIdx:] {
@@ -683,6 +810,43 @@ func (b bitmap) cardinality() int {
 	return num
 }
 
+// rangeCardinality returns the number of set bits in range [start, last], both included.
+func (b bitmap) rangeCardinality(start, last uint16) int {
+	data := b[startIdx:]
+	si, li := start>>4, last>>4
+	// Bits are ordered from the most significant one, so masks keep bits at positions
+	// >= start%16 and <= last%16 respectively.
+	startMask := uint16(math.MaxUint16) >> (start & 0xF)
+	lastMask := uint16(math.MaxUint16) << (15 - last&0xF)
+	if si == li {
+		return bits.OnesCount16(data[si] & startMask & lastMask)
+	}
+
+	num := bits.OnesCount16(data[si]&startMask) + bits.OnesCount16(data[li]&lastMask)
+	for _, x := range data[si+1 : li] {
+		num += bits.OnesCount16(x)
+	}
+	return num
+}
+
+// flipRange inverts bits in range [start, last], both included, and updates cardinality.
+func (b bitmap) flipRange(start, last uint16) {
+	data := b[startIdx:]
+	si, li := start>>4, last>>4
+	startMask := uint16(math.MaxUint16) >> (start & 0xF)
+	lastMask := uint16(math.MaxUint16) << (15 - last&0xF)
+	if si == li {
+		data[si] ^= startMask & lastMask
+	} else {
+		data[si] ^= startMask
+		data[li] ^= lastMask
+		for i := si + 1; i < li; i++ {
+			data[i] = ^data[i]
+		}
+	}
+	setCardinality(b, b.cardinality())
+}
+
 var zeroContainer = make([]uint16, maxContainerSize)
 
 func (b bitmap) zeroOut() {
@@ -699,6 +863,31 @@ func containerOr(ac, bc, buf []uint16, runMode int) []uint16 {
 	at := ac[indexType]
 	bt := bc[indexType]
 
+	// Run containers are merged as bitmaps. Bitmap on the left can be merged inline, otherwise
+	// the left container is converted to bitmap in buf first.
+	if at == typeBitmap && bt == typeRun {
+		left := bitmap(ac)
+		right := run(bc)
+		return left.orRun(right, buf, runMode)
+	}
+	if at == typeRun || bt == typeRun {
+		var out bitmap
+		if at == typeArray {
+			out = array(ac).toBitmapContainer(buf)
+		} else {
+			out = run(ac).toBitmapContainer(buf)
+		}
+		switch bt {
+		case typeArray:
+			out.orArray(array(bc), nil, runMode|runInline)
+		case typeBitmap:
+			out.orBitmap(bitmap(bc), nil, runMode|runInline)
+		case typeRun:
+			out.orRun(run(bc), nil, runMode|runInline)
+		}
+		return out
+	}
+
 	if at == typeArray && bt == typeArray {
 		left := array(ac)
 		right := array(bc)
@@ -737,6 +926,10 @@ func containerAnd(ac, bc []uint16) []uint16 {
 	at := ac[indexType]
 	bt := bc[indexType]
 
+	if at == typeRun || bt == typeRun {
+		return containerAndAlt(ac, bc, nil, 0)
+	}
+
 	if at == typeArray && bt == typeArray {
 		left := array(ac)
 		right := array(bc)
@@ -766,6 +959,10 @@ func containerAndNot(ac, bc, buf []uint16) []uint16 {
 	at := ac[indexType]
 	bt := bc[indexType]
 
+	if at == typeRun || bt == typeRun {
+		return containerAndNotAlt(ac, bc, buf, 0)
+	}
+
 	if at == typeArray && bt == typeArray {
 		left := array(ac)
 		right := array(bc)
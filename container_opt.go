@@ -35,6 +35,31 @@ func containerAndAlt(ac, bc []uint16, optBuf []uint16, runMode int) []uint16 {
 		right := bitmap(bc)
 		return left.andBitmapAlt(right, optBuf, runMode)
 	}
+	if at == typeArray && bt == typeRun {
+		left := array(ac)
+		right := run(bc)
+		return left.andRunAlt(right, optBuf, runMode)
+	}
+	if at == typeBitmap && bt == typeRun {
+		left := bitmap(ac)
+		right := run(bc)
+		return left.andRunAlt(right, optBuf, runMode)
+	}
+	if at == typeRun && bt == typeArray {
+		left := run(ac)
+		right := array(bc)
+		return left.andArrayAlt(right, optBuf, runMode)
+	}
+	if at == typeRun && bt == typeBitmap {
+		left := run(ac)
+		right := bitmap(bc)
+		return left.andBitmapAlt(right, optBuf, runMode)
+	}
+	if at == typeRun && bt == typeRun {
+		left := run(ac)
+		right := run(bc)
+		return left.andRunAlt(right, optBuf, runMode)
+	}
 	panic("containerAnd: We should not reach here")
 }
 
@@ -287,6 +312,31 @@ func containerAndNotAlt(ac, bc []uint16, optBuf []uint16, runMode int) []uint16
 		right := bitmap(bc)
 		return left.andNotBitmapAlt(right, optBuf, runMode)
 	}
+	if at == typeArray && bt == typeRun {
+		left := array(ac)
+		right := run(bc)
+		return left.andNotRunAlt(right, optBuf, runMode)
+	}
+	if at == typeBitmap && bt == typeRun {
+		left := bitmap(ac)
+		right := run(bc)
+		return left.andNotRunAlt(right, optBuf, runMode)
+	}
+	if at == typeRun && bt == typeArray {
+		left := run(ac)
+		right := array(bc)
+		return left.andNotArrayAlt(right, optBuf, runMode)
+	}
+	if at == typeRun && bt == typeBitmap {
+		left := run(ac)
+		right := bitmap(bc)
+		return left.andNotBitmapAlt(right, optBuf, runMode)
+	}
+	if at == typeRun && bt == typeRun {
+		left := run(ac)
+		right := run(bc)
+		return left.andNotRunAlt(right, optBuf, runMode)
+	}
 	panic("containerAnd: We should not reach here")
 }
 
@@ -478,6 +528,31 @@ func containerOrAlt(ac, bc []uint16, buf []uint16, runMode int) []uint16 {
 		right := bitmap(bc)
 		return left.orBitmapAlt(right, buf, runMode)
 	}
+	if at == typeArray && bt == typeRun {
+		left := array(ac)
+		right := run(bc)
+		return left.orRunAlt(right, buf, runMode)
+	}
+	if at == typeBitmap && bt == typeRun {
+		left := bitmap(ac)
+		right := run(bc)
+		return left.orRunAlt(right, buf, runMode)
+	}
+	if at == typeRun && bt == typeArray {
+		left := run(ac)
+		right := array(bc)
+		return left.orArrayAlt(right, buf, runMode)
+	}
+	if at == typeRun && bt == typeBitmap {
+		left := run(ac)
+		right := bitmap(bc)
+		return left.orBitmapAlt(right, buf, runMode)
+	}
+	if at == typeRun && bt == typeRun {
+		left := run(ac)
+		right := run(bc)
+		return left.orRunAlt(right, buf, runMode)
+	}
 	panic("containerOr: We should not reach here")
 }
 
@@ -699,6 +774,355 @@ func (b bitmap) orBitmapAlt(other bitmap, buf []uint16, runMode int) []uint16 {
 	return nil
 }
 
+func containerXorAlt(ac, bc []uint16, buf []uint16, runMode int) []uint16 {
+	// Run containers are xored as bitmaps. Left run container can not fit bitmap result,
+	// therefore it is always returned.
+	if bc[indexType] == typeRun {
+		bc = run(bc).toBitmapContainer(nil)
+	}
+	if ac[indexType] == typeRun {
+		ac = run(ac).toBitmapContainer(nil)
+		return containerXorAlt(ac, bc, buf, runMode&^runInline)
+	}
+
+	at := ac[indexType]
+	bt := bc[indexType]
+
+	if at == typeArray && bt == typeArray {
+		left := array(ac)
+		right := array(bc)
+		return left.xorArrayAlt(right, buf, runMode)
+	}
+	if at == typeArray && bt == typeBitmap {
+		left := array(ac)
+		right := bitmap(bc)
+		return left.xorBitmapAlt(right, buf, runMode)
+	}
+	if at == typeBitmap && bt == typeArray {
+		left := bitmap(ac)
+		right := array(bc)
+		return left.xorArrayAlt(right, buf, runMode)
+	}
+	if at == typeBitmap && bt == typeBitmap {
+		left := bitmap(ac)
+		right := bitmap(bc)
+		return left.xorBitmapAlt(right, buf, runMode)
+	}
+	panic("containerXor: We should not reach here")
+}
+
+func (c array) xorArrayAlt(other array, buf []uint16, runMode int) []uint16 {
+	cnum := getCardinality(c)
+	onum := getCardinality(other)
+
+	if onum == 0 {
+		if runMode&runInline == 0 {
+			return resizeArray(c, buf)
+		}
+		// do nothing, nothing to xor
+		return nil
+	}
+	if cnum == 0 {
+		if runMode&runInline == 0 {
+			return resizeArray(other, buf)
+		}
+		// overwrite array or return if does not fit
+		lastIdx := startIdx + uint16(onum)
+		if c[indexSize] < lastIdx {
+			return resizeArray(other, buf)
+		}
+		setCardinality(c, onum)
+		copy(c[startIdx:], other[startIdx:lastIdx])
+		return nil
+	}
+
+	// merge
+	out := buf
+	sum := cnum + onum
+	size := startIdx + uint16(sum)
+	// if merged arrays may exceed max container size convert to bitmap
+	if size >= maxContainerSize/5*3 {
+		copy(out, zeroContainer)
+		out[indexType] = typeBitmap
+		out[indexSize] = maxContainerSize
+
+		for _, x := range c.all() {
+			idx := x >> 4
+			pos := x & 0xF
+			out[startIdx+idx] |= bitmapMask[pos]
+		}
+		num := cnum
+		for _, x := range other.all() {
+			idx := x >> 4
+			pos := x & 0xF
+			out[startIdx+idx] ^= bitmapMask[pos]
+			if has := out[startIdx+idx]&bitmapMask[pos] > 0; has {
+				num++
+			} else {
+				num--
+			}
+		}
+		setCardinality(out, num)
+
+		if runMode&runInline == 0 {
+			return out
+		}
+		if c[indexSize] < maxContainerSize {
+			return out
+		}
+		copy(c, out)
+		return nil
+	}
+
+	num := exclusiveUnion2by2(c.all(), other.all(), out[startIdx:])
+	lastIdx := startIdx + uint16(num)
+
+	if runMode&runInline == 0 {
+		return bufAsArray(out, lastIdx)
+	}
+	if c[indexSize] < lastIdx {
+		return bufAsArray(out, lastIdx)
+	}
+	setCardinality(c, num)
+	copy(c[startIdx:], out[startIdx:lastIdx])
+	return nil
+}
+
+func (c array) xorBitmapAlt(other bitmap, buf []uint16, runMode int) []uint16 {
+	cnum := getCardinality(c)
+	onum := getCardinality(other)
+
+	if onum == 0 {
+		if runMode&runInline == 0 {
+			return resizeArray(c, buf)
+		}
+		// do nothing, nothing to xor
+		return nil
+	}
+	if cnum == 0 {
+		if runMode&runInline == 0 {
+			return other
+		}
+		// overwrite converting to bitmap or return bitmap if does not fit
+		if c[indexSize] != maxContainerSize {
+			return other
+		}
+		copy(c, other)
+		return nil
+	}
+
+	// merge
+	out := buf
+	copy(out, other)
+	num := onum
+	for _, x := range c.all() {
+		idx := x >> 4
+		pos := x & 0xF
+		out[startIdx+idx] ^= bitmapMask[pos]
+		if has := out[startIdx+idx]&bitmapMask[pos] > 0; has {
+			num++
+		} else {
+			num--
+		}
+	}
+	setCardinality(out, num)
+
+	if runMode&runInline == 0 {
+		return out
+	}
+	if c[indexSize] != maxContainerSize {
+		return out
+	}
+	copy(c, out)
+	return nil
+}
+
+func (b bitmap) xorArrayAlt(other array, buf []uint16, runMode int) []uint16 {
+	bnum := getCardinality(b)
+	onum := getCardinality(other)
+
+	if onum == 0 {
+		if runMode&runInline == 0 {
+			return b
+		}
+		// do nothing, nothing to xor
+		return nil
+	}
+	if bnum == 0 {
+		if runMode&runInline == 0 {
+			return resizeArray(other, buf)
+		}
+		// proceed to merge
+	}
+
+	// merge
+	out := b
+	if runMode&runInline == 0 {
+		out = buf
+		copy(out, b)
+	}
+
+	num := bnum
+	for _, x := range other.all() {
+		idx := x >> 4
+		pos := x & 0xF
+		out[startIdx+idx] ^= bitmapMask[pos]
+		if has := out[startIdx+idx]&bitmapMask[pos] > 0; has {
+			num++
+		} else {
+			num--
+		}
+	}
+	setCardinality(out, num)
+
+	if runMode&runInline == 0 {
+		return out
+	}
+	return nil
+}
+
+func (b bitmap) xorBitmapAlt(other bitmap, buf []uint16, runMode int) []uint16 {
+	bnum := getCardinality(b)
+	onum := getCardinality(other)
+
+	if onum == 0 {
+		if runMode&runInline == 0 {
+			return b
+		}
+		// do nothing, nothing to xor
+		return nil
+	}
+	if bnum == 0 {
+		if runMode&runInline == 0 {
+			return other
+		}
+		// overwrite bitmap
+		copy(b, other)
+		return nil
+	}
+
+	// merge
+	out := b
+	if runMode&runInline == 0 {
+		out = buf
+		copy(out, b)
+	}
+
+	dst64 := uint16To64SliceUnsafe(out[startIdx:])
+	src64 := uint16To64SliceUnsafe(other[startIdx:])
+	var num int
+	for i := range dst64 {
+		dst64[i] ^= src64[i]
+		num += bits.OnesCount64(dst64[i])
+	}
+	setCardinality(out, num)
+
+	if runMode&runInline == 0 {
+		return out
+	}
+	return nil
+}
+
+// containerAndCardinality returns cardinality of intersection of given containers,
+// without materializing it.
+func containerAndCardinality(ac, bc []uint16) int {
+	at := ac[indexType]
+	bt := bc[indexType]
+
+	if at == typeRun {
+		return run(ac).andCardinality(bc)
+	}
+	if bt == typeRun {
+		return run(bc).andCardinality(ac)
+	}
+	if at == typeArray && bt == typeArray {
+		return intersection2by2Cardinality(array(ac).all(), array(bc).all())
+	}
+	if at == typeArray && bt == typeBitmap {
+		return bitmap(bc).andArrayCardinality(array(ac))
+	}
+	if at == typeBitmap && bt == typeArray {
+		return bitmap(ac).andArrayCardinality(array(bc))
+	}
+	if at == typeBitmap && bt == typeBitmap {
+		a64 := uint16To64SliceUnsafe(ac[startIdx:])
+		b64 := uint16To64SliceUnsafe(bc[startIdx:])
+		var num int
+		for i := range a64 {
+			num += bits.OnesCount64(a64[i] & b64[i])
+		}
+		return num
+	}
+	panic("containerAndCardinality: We should not reach here")
+}
+
+// containerIntersects returns true if given containers have at least one element in common.
+func containerIntersects(ac, bc []uint16) bool {
+	at := ac[indexType]
+	bt := bc[indexType]
+
+	if at == typeArray && bt == typeArray {
+		return intersects2by2(array(ac).all(), array(bc).all())
+	}
+	if at == typeArray && bt == typeBitmap {
+		return bitmap(bc).intersectsArray(array(ac))
+	}
+	if at == typeBitmap && bt == typeArray {
+		return bitmap(ac).intersectsArray(array(bc))
+	}
+	if at == typeBitmap && bt == typeBitmap {
+		a64 := uint16To64SliceUnsafe(ac[startIdx:])
+		b64 := uint16To64SliceUnsafe(bc[startIdx:])
+		for i := range a64 {
+			if a64[i]&b64[i] != 0 {
+				return true
+			}
+		}
+		return false
+	}
+	return containerAndCardinality(ac, bc) > 0
+}
+
+// containerEquals returns true if given containers hold the same elements,
+// regardless of their types and sizes.
+func containerEquals(ac, bc []uint16) bool {
+	card := getCardinality(ac)
+	if card != getCardinality(bc) {
+		return false
+	}
+
+	if at := ac[indexType]; at == bc[indexType] {
+		switch at {
+		case typeArray:
+			return equal(array(ac).all(), array(bc).all())
+		case typeBitmap:
+			return equal(ac[startIdx:], bc[startIdx:])
+		case typeRun:
+			return equal(ac[indexNumRuns:runSize(run(ac).numRuns())], bc[indexNumRuns:runSize(run(bc).numRuns())])
+		}
+	}
+	return containerAndCardinality(ac, bc) == card
+}
+
+func (b bitmap) andArrayCardinality(other array) int {
+	var num int
+	for _, x := range other.all() {
+		if b.has(x) {
+			num++
+		}
+	}
+	return num
+}
+
+func (b bitmap) intersectsArray(other array) bool {
+	for _, x := range other.all() {
+		if b.has(x) {
+			return true
+		}
+	}
+	return false
+}
+
 func resizeArray(c array, out []uint16) []uint16 {
 	csize := c[indexSize]
 	cnum := getCardinality(c)
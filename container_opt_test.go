@@ -2,6 +2,8 @@ package sroar
 
 import (
 	"fmt"
+	"math"
+	"math/rand"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -38,3 +40,31 @@ func TestContainerExtremes(t *testing.T) {
 		}
 	})
 }
+
+func TestBitmapRangeCardinality(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	b := bitmap(make([]uint16, maxContainerSize))
+	for i := 0; i < 20000; i++ {
+		b.add(uint16(rnd.Intn(maxCardinality)))
+	}
+
+	for i := 0; i < 1000; i++ {
+		start := uint16(rnd.Intn(maxCardinality))
+		last := start + uint16(rnd.Intn(maxCardinality-int(start)))
+		if i%10 == 0 {
+			last = start + uint16(rnd.Intn(16))
+			if last < start {
+				last = start
+			}
+		}
+
+		var expected int
+		for x := int(start); x <= int(last); x++ {
+			if b.has(uint16(x)) {
+				expected++
+			}
+		}
+		require.Equalf(t, expected, b.rangeCardinality(start, last), "range [%d, %d]", start, last)
+	}
+	require.Equal(t, b.cardinality(), b.rangeCardinality(0, math.MaxUint16))
+}
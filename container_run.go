@@ -0,0 +1,1087 @@
+package sroar
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// run container stores sorted, non-overlapping and non-adjacent intervals of values.
+// It uses the same 4 uint16s header as other containers. The first uint16 after the header
+// stores the number of runs, followed by the runs themselves. Each run is stored as a pair of
+// uint16s [start, last], both included.
+//
+// run[4] -> number of runs.
+// run[5] -> start of the 0th run, run[6] -> last of the 0th run, and so on.
+//
+// Because runs are non-adjacent, there can be at most 2^15 runs in a container, so the number
+// of runs always fits in a uint16.
+
+const (
+	indexNumRuns int    = int(startIdx)
+	runStartIdx  uint16 = startIdx + 1
+)
+
+type run []uint16
+
+// runSize returns the size of a run container holding n runs, expressed in Uint16.
+func runSize(n int) int { return int(runStartIdx) + 2*n }
+
+func (r run) numRuns() int       { return int(r[indexNumRuns]) }
+func (r run) setNumRuns(n int)   { r[indexNumRuns] = uint16(n) }
+func (r run) start(i int) uint16 { return r[int(runStartIdx)+2*i] }
+func (r run) last(i int) uint16  { return r[int(runStartIdx)+2*i+1] }
+
+func (r run) setRun(i int, start, last uint16) {
+	r[int(runStartIdx)+2*i] = start
+	r[int(runStartIdx)+2*i+1] = last
+}
+
+// isFull returns true if there is no space left in the container for another run.
+func (r run) isFull() bool {
+	return runSize(r.numRuns()+1) > len(r)
+}
+
+// find returns the index of the first run whose last element is >= x. If all the runs end
+// before x, then N is returned where N = number of runs in the container.
+func (r run) find(x uint16) int {
+	lo, hi := 0, r.numRuns()
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if r.last(mid) < x {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+func (r run) has(x uint16) bool {
+	i := r.find(x)
+	return i < r.numRuns() && r.start(i) <= x
+}
+
+func (r run) insertRunAt(i int, start, last uint16) {
+	n := r.numRuns()
+	off := int(runStartIdx) + 2*i
+	copy(r[off+2:runSize(n+1)], r[off:runSize(n)])
+	r.setRun(i, start, last)
+	r.setNumRuns(n + 1)
+}
+
+func (r run) removeRunAt(i int) {
+	n := r.numRuns()
+	off := int(runStartIdx) + 2*i
+	copy(r[off:], r[off+2:runSize(n)])
+	r.setNumRuns(n - 1)
+}
+
+// add adds x to the container. The caller must ensure that the container is not full, because
+// adding x might require a new run.
+func (r run) add(x uint16) bool {
+	n := r.numRuns()
+	i := r.find(x)
+	if i < n && r.start(i) <= x {
+		return false
+	}
+
+	// x lies between run i-1 and run i. Check if it can extend any of them.
+	joinPrev := i > 0 && r.last(i-1)+1 == x
+	joinNext := i < n && r.start(i) == x+1
+	switch {
+	case joinPrev && joinNext:
+		r.setRun(i-1, r.start(i-1), r.last(i))
+		r.removeRunAt(i)
+	case joinPrev:
+		r.setRun(i-1, r.start(i-1), x)
+	case joinNext:
+		r.setRun(i, x, r.last(i))
+	default:
+		r.insertRunAt(i, x, x)
+	}
+	incrCardinality(r)
+	return true
+}
+
+// remove removes x from the container. The caller must ensure that the container is not full,
+// because removing x from the middle of a run splits it in two.
+func (r run) remove(x uint16) bool {
+	i := r.find(x)
+	if i == r.numRuns() || r.start(i) > x {
+		return false
+	}
+
+	start, last := r.start(i), r.last(i)
+	switch {
+	case start == last:
+		r.removeRunAt(i)
+	case x == start:
+		r.setRun(i, start+1, last)
+	case x == last:
+		r.setRun(i, start, last-1)
+	default:
+		r.setRun(i, start, x-1)
+		r.insertRunAt(i+1, x+1, last)
+	}
+	setCardinality(r, getCardinality(r)-1)
+	return true
+}
+
+// removeRange removes [lo, hi] from the container. The caller must ensure that the container is
+// not full, because the range might split a run in two.
+func (r run) removeRange(lo, hi uint16) {
+	if hi < lo {
+		panic(fmt.Sprintf("args must satisfy lo <= hi, got lo: %d, hi: %d\n", lo, hi))
+	}
+	n := r.numRuns()
+	i := r.find(lo)
+	j := r.find(hi)
+	if j < n && r.start(j) <= hi {
+		j++
+	}
+	// Runs [i, j) intersect with [lo, hi].
+	if i >= j {
+		return
+	}
+
+	var removed int
+	for k := i; k < j; k++ {
+		removed += int(min16(r.last(k), hi)) - int(max16(r.start(k), lo)) + 1
+	}
+
+	// Parts of the first and the last intersecting runs might lie outside of [lo, hi].
+	var pieces [2][2]uint16
+	var np int
+	if start := r.start(i); start < lo {
+		pieces[np] = [2]uint16{start, lo - 1}
+		np++
+	}
+	if last := r.last(j - 1); last > hi {
+		pieces[np] = [2]uint16{hi + 1, last}
+		np++
+	}
+
+	off := int(runStartIdx) + 2*i
+	copy(r[off+2*np:], r[int(runStartIdx)+2*j:runSize(n)])
+	for k := 0; k < np; k++ {
+		r.setRun(i+k, pieces[k][0], pieces[k][1])
+	}
+	r.setNumRuns(n - (j - i) + np)
+	setCardinality(r, getCardinality(r)-removed)
+}
+
+func (r run) zeroOut() {
+	r.setNumRuns(0)
+	setCardinality(r, 0)
+}
+
+func (r run) rank(x uint16) int {
+	i := r.find(x)
+	if i == r.numRuns() || r.start(i) > x {
+		return -1
+	}
+	var rank int
+	for k := 0; k < i; k++ {
+		rank += int(r.last(k)-r.start(k)) + 1
+	}
+	return rank + int(x-r.start(i))
+}
+
+func (r run) selectAt(idx int) uint16 {
+	for i := 0; i < r.numRuns(); i++ {
+		start, last := r.start(i), r.last(i)
+		if n := int(last-start) + 1; idx >= n {
+			idx -= n
+			continue
+		}
+		return start + uint16(idx)
+	}
+	panic("should not reach here")
+}
+
+func (r run) minimum() uint16 {
+	if r.numRuns() == 0 {
+		return 0
+	}
+	return r.start(0)
+}
+
+func (r run) maximum() uint16 {
+	n := r.numRuns()
+	if n == 0 {
+		return 0
+	}
+	return r.last(n - 1)
+}
+
+func (r run) nextValue(y uint16) (uint16, bool) {
+	i := r.find(y)
+	if i == r.numRuns() {
+		return 0, false
+	}
+	if start := r.start(i); start > y {
+		return start, true
+	}
+	return y, true
+}
+
+func (r run) previousValue(y uint16) (uint16, bool) {
+	i := r.find(y)
+	if i < r.numRuns() && r.start(i) <= y {
+		return y, true
+	}
+	if i > 0 {
+		return r.last(i - 1), true
+	}
+	return 0, false
+}
+
+func (r run) all() []uint16 {
+	res := make([]uint16, 0, getCardinality(r))
+	for i := 0; i < r.numRuns(); i++ {
+		start, last := r.start(i), r.last(i)
+		for x := start; ; x++ {
+			res = append(res, x)
+			if x == last {
+				break
+			}
+		}
+	}
+	return res
+}
+
+func (r run) cardinality() int {
+	var num int
+	for i := 0; i < r.numRuns(); i++ {
+		num += int(r.last(i)-r.start(i)) + 1
+	}
+	return num
+}
+
+func (r run) rangeCardinality(start, last uint16) int {
+	var num int
+	for i := r.find(start); i < r.numRuns() && r.start(i) <= last; i++ {
+		s, l := r.start(i), r.last(i)
+		if s < start {
+			s = start
+		}
+		if l > last {
+			l = last
+		}
+		num += int(l-s) + 1
+	}
+	return num
+}
+
+func (r run) toBitmapContainer(buf []uint16) []uint16 {
+	if len(buf) == 0 {
+		buf = make([]uint16, maxContainerSize)
+	} else {
+		assert(len(buf) == maxContainerSize)
+		assert(len(buf) == copy(buf, zeroContainer))
+	}
+
+	b := bitmap(buf)
+	b[indexSize] = maxContainerSize
+	b[indexType] = typeBitmap
+	setCardinality(b, getCardinality(r))
+	b.setRuns(r)
+	return b
+}
+
+func (r run) String() string {
+	return fmt.Sprintf("Size: %d Runs: %v\n", r[indexSize], r[runStartIdx:runSize(r.numRuns())])
+}
+
+// andCardinality returns cardinality of intersection of run container and other container
+// of any type.
+func (r run) andCardinality(other []uint16) int {
+	var num int
+	switch other[indexType] {
+	case typeArray:
+		for _, x := range array(other).all() {
+			if r.has(x) {
+				num++
+			}
+		}
+	case typeBitmap:
+		b := bitmap(other)
+		for i := 0; i < r.numRuns(); i++ {
+			num += b.rangeCardinality(r.start(i), r.last(i))
+		}
+	case typeRun:
+		o := run(other)
+		for i, j := 0, 0; i < r.numRuns() && j < o.numRuns(); {
+			start := max(int(r.start(i)), int(o.start(j)))
+			last := min(int(r.last(i)), int(o.last(j)))
+			if start <= last {
+				num += last - start + 1
+			}
+			if r.last(i) < o.last(j) {
+				i++
+			} else {
+				j++
+			}
+		}
+	}
+	return num
+}
+
+// numRuns returns the number of runs needed to represent the array.
+func (c array) numRuns() int {
+	var num int
+	vals := c.all()
+	for i, x := range vals {
+		if i == 0 || vals[i-1]+1 != x {
+			num++
+		}
+	}
+	return num
+}
+
+func (c array) toRunContainer(buf []uint16) []uint16 {
+	sz := runSize(c.numRuns())
+	if len(buf) == 0 {
+		buf = make([]uint16, sz)
+	}
+	r := run(buf[:sz])
+	r[indexSize] = uint16(sz)
+	r[indexType] = typeRun
+	setCardinality(r, getCardinality(c))
+
+	var n int
+	for _, x := range c.all() {
+		n = appendRun(r, n, x, x)
+	}
+	r.setNumRuns(n)
+	return r
+}
+
+// numRuns returns the number of runs needed to represent the bitmap.
+func (b bitmap) numRuns() int {
+	var num int
+	var carry uint16
+	for _, w := range b[startIdx:] {
+		// A run starts at every set bit, which is not preceded by another set bit. Bits are
+		// ordered from the most significant one, so the preceding bit is the one on the left.
+		num += bits.OnesCount16(w &^ (w>>1 | carry<<15))
+		carry = w & 1
+	}
+	return num
+}
+
+func (b bitmap) toRunContainer(buf []uint16) []uint16 {
+	sz := runSize(b.numRuns())
+	if len(buf) == 0 {
+		buf = make([]uint16, sz)
+	}
+	r := run(buf[:sz])
+	r[indexSize] = uint16(sz)
+	r[indexType] = typeRun
+	setCardinality(r, getCardinality(b))
+
+	var n int
+	data := b[startIdx:]
+	for idx := 0; idx < len(data); idx++ {
+		w := data[idx]
+		for w != 0 {
+			// Find the next run of set bits within the word.
+			lz := bits.LeadingZeros16(w)
+			ones := bits.LeadingZeros16(^(w << lz))
+			x := uint16(idx*16 + lz)
+			n = appendRun(r, n, x, x+uint16(ones)-1)
+			if lz+ones == 16 {
+				break
+			}
+			w &= math.MaxUint16 >> (lz + ones)
+		}
+	}
+	r.setNumRuns(n)
+	return r
+}
+
+// setRuns sets all the values of the given run container in the bitmap. It doesn't update the
+// cardinality of the bitmap.
+func (b bitmap) setRuns(other run) {
+	for i := 0; i < other.numRuns(); i++ {
+		b.setRange(int(other.start(i)), int(other.last(i)), nil)
+	}
+}
+
+// appendRun appends [start, last] as the nth run of r, merging it with the previous run if they
+// overlap or are adjacent. Runs must be appended in the increasing order of their start. It
+// returns the number of runs in r.
+func appendRun(r run, n int, start, last uint16) int {
+	if n > 0 {
+		if prev := r.last(n - 1); uint32(start) <= uint32(prev)+1 {
+			if last > prev {
+				r.setRun(n-1, r.start(n-1), last)
+			}
+			return n
+		}
+	}
+	r.setRun(n, start, last)
+	return n + 1
+}
+
+// runBuf returns a buffer big enough to hold a run container of numRuns runs. The given buf is
+// returned if it is big enough.
+func runBuf(buf []uint16, numRuns int) []uint16 {
+	sz := runSize(numRuns)
+	if sz <= 2048 {
+		sz = int(roundSize(uint16(sz)))
+	} else if sz < maxContainerSize {
+		sz = maxContainerSize
+	}
+	if len(buf) >= sz {
+		return buf
+	}
+	return make([]uint16, sz)
+}
+
+// bufAsRun turns buf holding numRuns runs into a run container. If the run container would
+// need more than 2048 Uint16s, it's converted to a bitmap container instead.
+func bufAsRun(buf []uint16, numRuns int) []uint16 {
+	r := run(buf)
+	r.setNumRuns(numRuns)
+	setCardinality(r, r.cardinality())
+
+	sz := runSize(numRuns)
+	if sz > 2048 {
+		return r.toBitmapContainer(nil)
+	}
+	out := buf[:roundSize(uint16(sz))]
+	out[indexType] = typeRun
+	out[indexSize] = uint16(len(out))
+	return out
+}
+
+// usedSize returns the number of Uint16s used by the data of the container, including header.
+func usedSize(c []uint16) int {
+	switch c[indexType] {
+	case typeArray:
+		return int(startIdx) + getCardinality(c)
+	case typeRun:
+		return runSize(run(c).numRuns())
+	}
+	return maxContainerSize
+}
+
+// writeInline overwrites the container dst with src, if src fits into the space of dst. The size
+// of dst is kept intact. It returns false if src doesn't fit.
+func writeInline(dst, src []uint16) bool {
+	sz := usedSize(src)
+	if sz > len(dst) {
+		return false
+	}
+	copy(dst[indexType:], src[indexType:sz])
+	return true
+}
+
+// replaceInline is used by inline operations on run containers, whose result might not fit into
+// the space of the run container. It returns nil if res was written over r, otherwise res is
+// returned to be placed by the caller.
+func (r run) replaceInline(res []uint16) []uint16 {
+	if writeInline(r, res) {
+		return nil
+	}
+	return res
+}
+
+func runUnion(a, b run, out run) int {
+	var n int
+	ai, an := 0, a.numRuns()
+	bi, bn := 0, b.numRuns()
+	for ai < an || bi < bn {
+		if bi == bn || (ai < an && a.start(ai) <= b.start(bi)) {
+			n = appendRun(out, n, a.start(ai), a.last(ai))
+			ai++
+		} else {
+			n = appendRun(out, n, b.start(bi), b.last(bi))
+			bi++
+		}
+	}
+	return n
+}
+
+func runUnionArray(a run, b array, out run) int {
+	var n int
+	vals := b.all()
+	ai, an := 0, a.numRuns()
+	bi, bn := 0, len(vals)
+	for ai < an || bi < bn {
+		if bi == bn || (ai < an && a.start(ai) <= vals[bi]) {
+			n = appendRun(out, n, a.start(ai), a.last(ai))
+			ai++
+		} else {
+			n = appendRun(out, n, vals[bi], vals[bi])
+			bi++
+		}
+	}
+	return n
+}
+
+func runIntersection(a, b run, out run) int {
+	var n int
+	ai, an := 0, a.numRuns()
+	bi, bn := 0, b.numRuns()
+	for ai < an && bi < bn {
+		start := max16(a.start(ai), b.start(bi))
+		last := min16(a.last(ai), b.last(bi))
+		if start <= last {
+			n = appendRun(out, n, start, last)
+		}
+		if a.last(ai) < b.last(bi) {
+			ai++
+		} else {
+			bi++
+		}
+	}
+	return n
+}
+
+func runDifference(a, b run, out run) int {
+	var n int
+	bi, bn := 0, b.numRuns()
+	for ai := 0; ai < a.numRuns(); ai++ {
+		start, last := a.start(ai), a.last(ai)
+		for bi < bn && b.last(bi) < start {
+			bi++
+		}
+		// cur is the smallest value of the current run, which isn't removed yet.
+		cur := uint32(start)
+		for k := bi; k < bn && b.start(k) <= last; k++ {
+			if bs := uint32(b.start(k)); bs > cur {
+				n = appendRun(out, n, uint16(cur), uint16(bs-1))
+			}
+			if bl := uint32(b.last(k)) + 1; bl > cur {
+				cur = bl
+			}
+		}
+		if cur <= uint32(last) {
+			n = appendRun(out, n, uint16(cur), last)
+		}
+	}
+	return n
+}
+
+func runDifferenceArray(a run, b array, out run) int {
+	var n int
+	vals := b.all()
+	bi, bn := 0, len(vals)
+	for ai := 0; ai < a.numRuns(); ai++ {
+		start, last := a.start(ai), a.last(ai)
+		for bi < bn && vals[bi] < start {
+			bi++
+		}
+		cur := uint32(start)
+		for ; bi < bn && vals[bi] <= last; bi++ {
+			if x := uint32(vals[bi]); x > cur {
+				n = appendRun(out, n, uint16(cur), uint16(x-1))
+			}
+			cur = uint32(vals[bi]) + 1
+		}
+		if cur <= uint32(last) {
+			n = appendRun(out, n, uint16(cur), last)
+		}
+	}
+	return n
+}
+
+func (c array) andRunAlt(other run, optBuf []uint16, runMode int) []uint16 {
+	cnum := getCardinality(c)
+	onum := getCardinality(other)
+
+	if cnum == 0 {
+		if runMode&runInline == 0 {
+			return emptyArrayContainer
+		}
+		// do nothing, array already empty
+		return nil
+	}
+	if onum == 0 {
+		if runMode&runInline == 0 {
+			return emptyArrayContainer
+		}
+		// reset array
+		c.zeroOut()
+		return nil
+	}
+
+	// merge
+	out := c
+	if runMode&runInline == 0 {
+		out = optBuf
+		if out == nil {
+			out = make([]uint16, roundSize(startIdx+uint16(cnum)))
+		}
+	}
+	lastIdx := startIdx
+	ri, rn := 0, other.numRuns()
+	for _, x := range c.all() {
+		for ri < rn && other.last(ri) < x {
+			ri++
+		}
+		if ri == rn {
+			break
+		}
+		if other.start(ri) <= x {
+			out[lastIdx] = x
+			lastIdx++
+		}
+	}
+
+	if runMode&runInline == 0 {
+		return bufAsArray(out, lastIdx)
+	}
+	setCardinality(c, int(lastIdx-startIdx))
+	return nil
+}
+
+func (b bitmap) andRunAlt(other run, optBuf []uint16, runMode int) []uint16 {
+	bnum := getCardinality(b)
+	onum := getCardinality(other)
+
+	if bnum == 0 {
+		if runMode&runInline == 0 {
+			return emptyArrayContainer
+		}
+		// do nothing, bitmap already empty
+		return nil
+	}
+	if onum == 0 {
+		if runMode&runInline == 0 {
+			return emptyArrayContainer
+		}
+		// reset bitmap
+		b.zeroOut()
+		return nil
+	}
+
+	// merge
+	out := b
+	if runMode&runInline == 0 {
+		out = copyBitmap(b, optBuf)
+	}
+
+	// Remove the gaps between the runs.
+	var lo int
+	for i := 0; i < other.numRuns(); i++ {
+		if start := int(other.start(i)); start > lo {
+			out.removeRange(uint16(lo), uint16(start-1))
+		}
+		lo = int(other.last(i)) + 1
+	}
+	if lo < maxCardinality {
+		out.removeRange(uint16(lo), math.MaxUint16)
+	}
+
+	if runMode&runInline == 0 {
+		return out
+	}
+	return nil
+}
+
+func (r run) andArrayAlt(other array, optBuf []uint16, runMode int) []uint16 {
+	res := other.andRunAlt(r, optBuf, 0)
+	if runMode&runInline == 0 {
+		return res
+	}
+	return r.replaceInline(res)
+}
+
+func (r run) andBitmapAlt(other bitmap, optBuf []uint16, runMode int) []uint16 {
+	res := other.andRunAlt(r, optBuf, 0)
+	if runMode&runInline == 0 {
+		return res
+	}
+	return r.replaceInline(res)
+}
+
+func (r run) andRunAlt(other run, optBuf []uint16, runMode int) []uint16 {
+	rnum := getCardinality(r)
+	onum := getCardinality(other)
+
+	if rnum == 0 {
+		if runMode&runInline == 0 {
+			return emptyArrayContainer
+		}
+		// do nothing, run already empty
+		return nil
+	}
+	if onum == 0 {
+		if runMode&runInline == 0 {
+			return emptyArrayContainer
+		}
+		// reset run
+		r.zeroOut()
+		return nil
+	}
+
+	// merge
+	out := runBuf(optBuf, r.numRuns()+other.numRuns())
+	res := bufAsRun(out, runIntersection(r, other, out))
+
+	if runMode&runInline == 0 {
+		return res
+	}
+	return r.replaceInline(res)
+}
+
+func (c array) andNotRunAlt(other run, optBuf []uint16, runMode int) []uint16 {
+	cnum := getCardinality(c)
+	onum := getCardinality(other)
+
+	if cnum == 0 {
+		if runMode&runInline == 0 {
+			return emptyArrayContainer
+		}
+		// do nothing, array already empty
+		return nil
+	}
+	if onum == 0 {
+		if runMode&runInline == 0 {
+			return resizeArray(c, optBuf)
+		}
+		// do nothing, nothing to remove
+		return nil
+	}
+
+	// merge
+	out := c
+	if runMode&runInline == 0 {
+		out = optBuf
+		if out == nil {
+			out = make([]uint16, roundSize(startIdx+uint16(cnum)))
+		}
+	}
+	lastIdx := startIdx
+	ri, rn := 0, other.numRuns()
+	for _, x := range c.all() {
+		for ri < rn && other.last(ri) < x {
+			ri++
+		}
+		if ri == rn || other.start(ri) > x {
+			out[lastIdx] = x
+			lastIdx++
+		}
+	}
+
+	if runMode&runInline == 0 {
+		return bufAsArray(out, lastIdx)
+	}
+	setCardinality(c, int(lastIdx-startIdx))
+	return nil
+}
+
+func (b bitmap) andNotRunAlt(other run, optBuf []uint16, runMode int) []uint16 {
+	bnum := getCardinality(b)
+	onum := getCardinality(other)
+
+	if bnum == 0 {
+		if runMode&runInline == 0 {
+			return emptyArrayContainer
+		}
+		// do nothing, bitmap already empty
+		return nil
+	}
+	if onum == 0 {
+		if runMode&runInline == 0 {
+			return b
+		}
+		// do nothing, nothing to remove
+		return nil
+	}
+
+	// merge
+	out := b
+	if runMode&runInline == 0 {
+		out = copyBitmap(b, optBuf)
+	}
+	for i := 0; i < other.numRuns(); i++ {
+		out.removeRange(other.start(i), other.last(i))
+	}
+
+	if runMode&runInline == 0 {
+		return out
+	}
+	return nil
+}
+
+func (r run) andNotArrayAlt(other array, optBuf []uint16, runMode int) []uint16 {
+	rnum := getCardinality(r)
+	onum := getCardinality(other)
+
+	if rnum == 0 {
+		if runMode&runInline == 0 {
+			return emptyArrayContainer
+		}
+		// do nothing, run already empty
+		return nil
+	}
+	if onum == 0 {
+		if runMode&runInline == 0 {
+			return r
+		}
+		// do nothing, nothing to remove
+		return nil
+	}
+
+	// merge
+	out := runBuf(optBuf, r.numRuns()+onum)
+	res := bufAsRun(out, runDifferenceArray(r, other, out))
+
+	if runMode&runInline == 0 {
+		return res
+	}
+	return r.replaceInline(res)
+}
+
+func (r run) andNotBitmapAlt(other bitmap, optBuf []uint16, runMode int) []uint16 {
+	rnum := getCardinality(r)
+	onum := getCardinality(other)
+
+	if rnum == 0 {
+		if runMode&runInline == 0 {
+			return emptyArrayContainer
+		}
+		// do nothing, run already empty
+		return nil
+	}
+	if onum == 0 {
+		if runMode&runInline == 0 {
+			return r
+		}
+		// do nothing, nothing to remove
+		return nil
+	}
+
+	// merge
+	out := r.toBitmapContainer(optBuf)
+	dst64 := uint16To64SliceUnsafe(out[startIdx:])
+	src64 := uint16To64SliceUnsafe(other[startIdx:])
+	var num int
+	for i := range dst64 {
+		dst64[i] &^= src64[i]
+		num += bits.OnesCount64(dst64[i])
+	}
+	setCardinality(out, num)
+
+	if runMode&runInline == 0 {
+		return out
+	}
+	return r.replaceInline(out)
+}
+
+func (r run) andNotRunAlt(other run, optBuf []uint16, runMode int) []uint16 {
+	rnum := getCardinality(r)
+	onum := getCardinality(other)
+
+	if rnum == 0 {
+		if runMode&runInline == 0 {
+			return emptyArrayContainer
+		}
+		// do nothing, run already empty
+		return nil
+	}
+	if onum == 0 {
+		if runMode&runInline == 0 {
+			return r
+		}
+		// do nothing, nothing to remove
+		return nil
+	}
+
+	// merge
+	out := runBuf(optBuf, r.numRuns()+other.numRuns())
+	res := bufAsRun(out, runDifference(r, other, out))
+
+	if runMode&runInline == 0 {
+		return res
+	}
+	return r.replaceInline(res)
+}
+
+func (c array) orRunAlt(other run, buf []uint16, runMode int) []uint16 {
+	cnum := getCardinality(c)
+	onum := getCardinality(other)
+
+	if onum == 0 {
+		if runMode&runInline == 0 {
+			return resizeArray(c, buf)
+		}
+		// do nothing, nothing to add
+		return nil
+	}
+	if cnum == 0 || onum == maxCardinality {
+		if runMode&runInline == 0 {
+			return other
+		}
+		// overwrite array or return run if does not fit
+		if writeInline(c, other) {
+			return nil
+		}
+		return other
+	}
+
+	// merge
+	out := runBuf(buf, cnum+other.numRuns())
+	res := bufAsRun(out, runUnionArray(other, c, out))
+
+	if runMode&runInline == 0 {
+		return res
+	}
+	if writeInline(c, res) {
+		return nil
+	}
+	return res
+}
+
+func (b bitmap) orRunAlt(other run, buf []uint16, runMode int) []uint16 {
+	bnum := getCardinality(b)
+	onum := getCardinality(other)
+
+	if onum == 0 || bnum == maxCardinality {
+		if runMode&runInline == 0 {
+			return b
+		}
+		// do nothing, nothing to add
+		return nil
+	}
+	if bnum == 0 && runMode&runInline == 0 {
+		return other
+	}
+
+	// merge
+	out := b
+	if runMode&runInline == 0 {
+		out = buf
+		copy(out, b)
+	}
+	out.setRuns(other)
+	setCardinality(out, out.cardinality())
+
+	if runMode&runInline == 0 {
+		return out
+	}
+	return nil
+}
+
+func (r run) orArrayAlt(other array, buf []uint16, runMode int) []uint16 {
+	rnum := getCardinality(r)
+	onum := getCardinality(other)
+
+	if onum == 0 || rnum == maxCardinality {
+		if runMode&runInline == 0 {
+			return r
+		}
+		// do nothing, nothing to add
+		return nil
+	}
+	if rnum == 0 {
+		if runMode&runInline == 0 {
+			return resizeArray(other, buf)
+		}
+		// overwrite run or return array if does not fit
+		if writeInline(r, other) {
+			return nil
+		}
+		return resizeArray(other, buf)
+	}
+
+	// merge
+	out := runBuf(buf, r.numRuns()+onum)
+	res := bufAsRun(out, runUnionArray(r, other, out))
+
+	if runMode&runInline == 0 {
+		return res
+	}
+	return r.replaceInline(res)
+}
+
+func (r run) orBitmapAlt(other bitmap, buf []uint16, runMode int) []uint16 {
+	rnum := getCardinality(r)
+	onum := getCardinality(other)
+
+	if onum == 0 || rnum == maxCardinality {
+		if runMode&runInline == 0 {
+			return r
+		}
+		// do nothing, nothing to add
+		return nil
+	}
+	if rnum == 0 || onum == maxCardinality {
+		if runMode&runInline == 0 {
+			return other
+		}
+		return r.replaceInline(other)
+	}
+
+	// merge
+	out := bitmap(buf)
+	copy(out, other)
+	out.setRuns(r)
+	setCardinality(out, out.cardinality())
+
+	if runMode&runInline == 0 {
+		return out
+	}
+	return r.replaceInline(out)
+}
+
+func (r run) orRunAlt(other run, buf []uint16, runMode int) []uint16 {
+	rnum := getCardinality(r)
+	onum := getCardinality(other)
+
+	if onum == 0 || rnum == maxCardinality {
+		if runMode&runInline == 0 {
+			return r
+		}
+		// do nothing, nothing to add
+		return nil
+	}
+	if rnum == 0 || onum == maxCardinality {
+		if runMode&runInline == 0 {
+			return other
+		}
+		return r.replaceInline(other)
+	}
+
+	// merge
+	out := runBuf(buf, r.numRuns()+other.numRuns())
+	res := bufAsRun(out, runUnion(r, other, out))
+
+	if runMode&runInline == 0 {
+		return res
+	}
+	return r.replaceInline(res)
+}
+
+// orRun is used by containerOr, which always merges run containers into bitmaps. It follows the
+// semantics of bitmap.orArray.
+func (b bitmap) orRun(other run, buf []uint16, runMode int) []uint16 {
+	if runMode&runInline > 0 {
+		buf = b
+	} else {
+		copy(buf, b)
+	}
+
+	if num := getCardinality(b); num == maxCardinality {
+		// do nothing. This bitmap is already full.
+
+	} else if runMode&runLazy > 0 || num == invalidCardinality {
+		// Avoid calculating the cardinality to speed up operations.
+		bitmap(buf).setRuns(other)
+		setCardinality(buf, invalidCardinality)
+
+	} else {
+		bitmap(buf).setRuns(other)
+		setCardinality(buf, bitmap(buf).cardinality())
+	}
+
+	if runMode&runInline > 0 {
+		return nil
+	}
+	return buf
+}
@@ -0,0 +1,251 @@
+package sroar
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// toRunBitmap returns a copy of the bitmap with all the containers converted to run containers.
+// Containers with too many runs to fit a run container are copied as they are.
+func toRunBitmap(bm *Bitmap) *Bitmap {
+	dst := NewBitmap()
+	for i := 0; i < bm.keys.numKeys(); i++ {
+		dst.setKey(bm.keys.key(i), 0)
+	}
+	for i := 0; i < bm.keys.numKeys(); i++ {
+		c := bm.getContainer(bm.keys.val(i))
+		r := c
+		switch c[indexType] {
+		case typeArray:
+			r = array(c).toRunContainer(nil)
+		case typeBitmap:
+			if runSize(bitmap(c).numRuns()) <= maxContainerSize {
+				r = bitmap(c).toRunContainer(nil)
+			}
+		}
+		offset := dst.newContainer(uint16(len(r)))
+		copy(dst.data[offset:], r)
+		dst.setKey(bm.keys.key(i), offset)
+	}
+	return dst
+}
+
+// runsBitmap creates a bitmap with numRuns runs of random length within the range [0, maxX).
+func runsBitmap(rnd *rand.Rand, numRuns int, maxLen, maxX uint64) *Bitmap {
+	bm := NewBitmap()
+	for i := 0; i < numRuns; i++ {
+		start := rnd.Uint64() % maxX
+		length := rnd.Uint64()%maxLen + 1
+		for x := start; x < start+length && x < maxX; x++ {
+			bm.Set(x)
+		}
+	}
+	return bm
+}
+
+func TestRunContainer(t *testing.T) {
+	t.Run("add and remove", func(t *testing.T) {
+		r := run(make([]uint16, maxContainerSize))
+		r[indexSize] = maxContainerSize
+		r[indexType] = typeRun
+
+		rnd := rand.New(rand.NewSource(1))
+		ref := make(map[uint16]struct{})
+		for i := 0; i < 5000; i++ {
+			x := uint16(rnd.Intn(2000))
+			_, ok := ref[x]
+			if rnd.Intn(3) > 0 {
+				ref[x] = struct{}{}
+				require.Equal(t, !ok, r.add(x))
+			} else {
+				delete(ref, x)
+				require.Equal(t, ok, r.remove(x))
+			}
+			require.Equal(t, len(ref), getCardinality(r))
+		}
+
+		expected := make([]uint16, 0, len(ref))
+		for x := range ref {
+			expected = append(expected, x)
+		}
+		sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+
+		require.Equal(t, expected, r.all())
+		require.Equal(t, len(expected), r.cardinality())
+		require.Equal(t, expected[0], r.minimum())
+		require.Equal(t, expected[len(expected)-1], r.maximum())
+		for i, x := range expected {
+			require.True(t, r.has(x))
+			require.Equal(t, i, r.rank(x))
+			require.Equal(t, x, r.selectAt(i))
+		}
+		for i := 1; i < r.numRuns(); i++ {
+			require.Greater(t, r.start(i), r.last(i-1)+1)
+		}
+	})
+
+	t.Run("remove range", func(t *testing.T) {
+		r := run(make([]uint16, maxContainerSize))
+		r[indexSize] = maxContainerSize
+		r[indexType] = typeRun
+		for x := uint16(0); x < 100; x++ {
+			r.add(x)
+		}
+		r.removeRange(10, 19)
+		r.removeRange(50, 50)
+		r.removeRange(90, 200)
+
+		require.Equal(t, 3, r.numRuns())
+		require.Equal(t, 79, getCardinality(r))
+		require.False(t, r.has(10))
+		require.False(t, r.has(50))
+		require.True(t, r.has(89))
+		require.False(t, r.has(90))
+	})
+
+	t.Run("conversions", func(t *testing.T) {
+		a := array(make([]uint16, 64))
+		a[indexSize] = 64
+		a[indexType] = typeArray
+		for _, x := range []uint16{1, 2, 3, 15, 16, 17, 40, 65535} {
+			a.add(x)
+		}
+
+		r := run(a.toRunContainer(nil))
+		require.Equal(t, 4, r.numRuns())
+		require.Equal(t, a.all(), r.all())
+		require.Equal(t, runSize(4), len(r))
+
+		b := bitmap(r.toBitmapContainer(nil))
+		require.Equal(t, 4, b.numRuns())
+		require.Equal(t, a.all(), b.all())
+
+		r2 := run(b.toRunContainer(nil))
+		require.Equal(t, []uint16(r), []uint16(r2))
+	})
+}
+
+func TestRunBitmap(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	bm := runsBitmap(rnd, 100, 1000, 1<<18)
+	rbm := toRunBitmap(bm)
+	arr := bm.ToArray()
+
+	t.Run("read", func(t *testing.T) {
+		require.Equal(t, bm.GetCardinality(), rbm.GetCardinality())
+		require.Equal(t, arr, rbm.ToArray())
+		require.Equal(t, bm.Minimum(), rbm.Minimum())
+		require.Equal(t, bm.Maximum(), rbm.Maximum())
+		assertMatches(t, bm, rbm)
+
+		for i := 0; i < 1000; i++ {
+			x := rnd.Uint64() % (1 << 18)
+			require.Equal(t, bm.Contains(x), rbm.Contains(x))
+			require.Equal(t, bm.Rank(x), rbm.Rank(x))
+		}
+		for i := 0; i < 1000; i++ {
+			idx := rnd.Uint64() % uint64(len(arr))
+			x, err := rbm.Select(idx)
+			require.NoError(t, err)
+			require.Equal(t, arr[idx], x)
+		}
+	})
+
+	t.Run("write", func(t *testing.T) {
+		bm := bm.Clone()
+		rbm := rbm.Clone()
+		for i := 0; i < 5000; i++ {
+			x := rnd.Uint64() % (1 << 18)
+			if rnd.Intn(2) == 0 {
+				require.Equal(t, bm.Set(x), rbm.Set(x))
+			} else {
+				require.Equal(t, bm.Remove(x), rbm.Remove(x))
+			}
+		}
+		assertMatches(t, bm, rbm)
+
+		for i := 0; i < 20; i++ {
+			lo := rnd.Uint64() % (1 << 18)
+			hi := lo + rnd.Uint64()%(1<<12)
+			bm.RemoveRange(lo, hi)
+			rbm.RemoveRange(lo, hi)
+		}
+		assertMatches(t, bm, rbm)
+	})
+
+	t.Run("fill up", func(t *testing.T) {
+		bm := bm.Clone()
+		rbm := rbm.Clone()
+		bm.FillUp(bm.Maximum() + 100)
+		rbm.FillUp(rbm.Maximum() + 100)
+		assertMatches(t, bm, rbm)
+		bm.FillUp(1 << 19)
+		rbm.FillUp(1 << 19)
+		assertMatches(t, bm, rbm)
+	})
+
+	t.Run("convert to bitmap containers", func(t *testing.T) {
+		rbm := rbm.Clone()
+		rbm.ConvertToBitmapContainers()
+		assertMatches(t, bm, rbm)
+	})
+}
+
+func TestRunBitmapMerge(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	for i := 0; i < 3; i++ {
+		a := runsBitmap(rnd, 60, 1000, 1<<18)
+		b := runsBitmap(rnd, 60, 1000, 1<<18)
+		c := NewBitmap()
+		for j := 0; j < 5000; j++ {
+			c.Set(rnd.Uint64() % (1 << 18))
+		}
+		ra, rb := toRunBitmap(a), toRunBitmap(b)
+
+		pairs := []struct {
+			name string
+			x, y *Bitmap
+			rx   *Bitmap
+			ry   *Bitmap
+		}{
+			{"runs", a, b, ra, rb},
+			{"run and other", a, c, ra, c},
+			{"other and run", c, a, c, ra},
+			{"sparse run and run", c, a, toRunBitmap(c), ra},
+			{"run and sparse run", a, c, ra, toRunBitmap(c)},
+		}
+
+		for _, p := range pairs {
+			t.Run(p.name, func(t *testing.T) {
+				and := And(p.x, p.y)
+				assertMatches(t, and,
+					And(p.rx, p.ry),
+					p.rx.Clone().And(p.ry),
+					p.rx.Clone().AndConc(p.ry, 4),
+				)
+
+				andNot := AndNot(p.x, p.y)
+				assertMatches(t, andNot,
+					AndNot(p.rx, p.ry),
+					p.rx.Clone().AndNot(p.ry),
+					p.rx.Clone().AndNotConc(p.ry, 4),
+				)
+
+				or := Or(p.x, p.y)
+				assertMatches(t, or,
+					Or(p.rx, p.ry),
+					p.rx.Clone().Or(p.ry),
+					p.rx.Clone().OrConc(p.ry, 4),
+					FastOr(p.rx, p.ry),
+				)
+
+				old := p.rx.Clone()
+				old.OrOld(p.ry)
+				assertMatches(t, or, old)
+			})
+		}
+	}
+}
@@ -17,6 +17,8 @@
 package sroar
 
 import (
+	"iter"
+	"math"
 	"math/bits"
 )
 
@@ -30,6 +32,14 @@ type Iterator struct {
 
 	bitmapIdx int
 	bitset    uint16
+
+	runIdx int
+	runVal uint16
+
+	// peeked is set by HasNext, which has to fetch the next element in advance.
+	peeked  bool
+	hasNext bool
+	nextVal uint64
 }
 
 func (bm *Bitmap) NewRangeIterators(numRanges int) []*Iterator {
@@ -60,12 +70,155 @@ func (bm *Bitmap) NewIterator() *Iterator {
 		keyIdx:    0,
 		contIdx:   -1,
 		bitmapIdx: -1,
+		runIdx:    -1,
+	}
+}
+
+// HasNext returns true if there are more elements to be returned by Next.
+func (it *Iterator) HasNext() bool {
+	if !it.peeked {
+		it.nextVal, it.hasNext = it.advance()
+		it.peeked = true
 	}
+	return it.hasNext
 }
 
+// Next returns the next element of the bitmap. Once the iterator is exhausted, 0 is returned,
+// which can not be distinguished from the element 0. Use HasNext to check whether
+// there are more elements.
 func (it *Iterator) Next() uint64 {
+	if it.peeked {
+		it.peeked = false
+		return it.nextVal
+	}
+	x, _ := it.advance()
+	return x
+}
+
+// Seek moves the iterator, so the following call to Next returns the smallest element >= x.
+// Skipped elements are not visited. The iterator can be moved both forward and backward,
+// within the range of keys it was created for.
+func (it *Iterator) Seek(x uint64) {
+	it.peeked = false
+	it.contIdx = -1
+	it.bitmapIdx = -1
+	it.bitset = 0
+	it.runIdx = -1
+
+	n := len(it.keys) / 2
+	if n == 0 {
+		return
+	}
+
+	// Find the first key >= key of x. Keys are followed by values, hence the indexes are doubled.
+	key := x & mask
+	lo, hi := 0, n
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if it.keys[2*mid] < key {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	if lo == n {
+		// All elements are smaller than x. Move the iterator past the last element.
+		it.keyIdx = 2 * (n - 1)
+		it.contIdx = getCardinality(it.bm.getContainer(it.keys[it.keyIdx+1])) - 1
+		return
+	}
+	it.keyIdx = 2 * lo
+	if it.keys[it.keyIdx] == key {
+		it.seekInContainer(uint16(x))
+	}
+}
+
+// seekInContainer sets the state of the iterator, so the following call to advance returns
+// the smallest element >= y of the current container.
+func (it *Iterator) seekInContainer(y uint16) {
+	cont := it.bm.getContainer(it.keys[it.keyIdx+1])
+	switch cont[indexType] {
+	case typeArray:
+		it.contIdx = array(cont).find(y) - 1
+	case typeBitmap:
+		if y > 0 {
+			it.contIdx = bitmap(cont).rangeCardinality(0, y-1) - 1
+		}
+		it.bitmapIdx = int(y >> 4)
+		it.bitset = cont[startIdx+y>>4] & (math.MaxUint16 >> (y & 0xF))
+	case typeRun:
+		r := run(cont)
+		i := r.find(y)
+		if i == r.numRuns() {
+			it.contIdx = getCardinality(cont) - 1
+			return
+		}
+		v := y
+		if start := r.start(i); start > v {
+			v = start
+		}
+		it.contIdx = r.rank(v) - 1
+		if v == r.start(i) {
+			// Next run is picked up on advance.
+			it.runIdx = i - 1
+			if i > 0 {
+				it.runVal = r.last(i - 1)
+			}
+		} else {
+			it.runIdx = i
+			it.runVal = v - 1
+		}
+	}
+}
+
+// advance moves the iterator to the next element and returns it. If the iterator is exhausted,
+// false is returned.
+func (it *Iterator) advance() (uint64, bool) {
+	key, cont, ok := it.container()
+	if !ok {
+		return 0, false
+	}
+
+	//  The container call assures that we can do next in this container.
+	it.contIdx++
+	switch cont[indexType] {
+	case typeArray:
+		return key | uint64(cont[int(startIdx)+it.contIdx]), true
+	case typeBitmap:
+		// A bitmap container is an array of uint16s.
+		// If the container is bitmap, go to the index which has a non-zero value.
+		for it.bitset == 0 && it.bitmapIdx+1 < len(cont[startIdx:]) {
+			it.bitmapIdx++
+			it.bitset = cont[int(startIdx)+it.bitmapIdx]
+		}
+		assert(it.bitset > 0)
+
+		// msbIdx is the index of most-significant bit. In this iteration we choose this set bit
+		// and make it zero.
+		msbIdx := uint16(bits.LeadingZeros16(it.bitset))
+		msb := 1 << (16 - msbIdx - 1)
+		it.bitset ^= uint16(msb)
+		return key | uint64(it.bitmapIdx*16+int(msbIdx)), true
+	case typeRun:
+		// Move to the next run once the current one is exhausted.
+		r := run(cont)
+		if it.runIdx < 0 || it.runVal == r.last(it.runIdx) {
+			it.runIdx++
+			it.runVal = r.start(it.runIdx)
+		} else {
+			it.runVal++
+		}
+		return key | uint64(it.runVal), true
+	}
+	return 0, false
+}
+
+// container returns the key and the container, which has elements left to be iterated over.
+// If the current container is exhausted, the iterator moves to the following one.
+func (it *Iterator) container() (uint64, []uint16, bool) {
 	if len(it.keys) == 0 {
-		return 0
+		return 0, nil, false
 	}
 
 	key := it.keys[it.keyIdx]
@@ -77,65 +230,472 @@ func (it *Iterator) Next() uint64 {
 	// is found, reset the variables responsible for container iteration.
 	for card == 0 || it.contIdx+1 >= card {
 		if it.keyIdx+2 >= len(it.keys) {
-			return 0
+			return 0, nil, false
 		}
 		// jump by 2 because key is followed by a value
 		it.keyIdx += 2
 		it.contIdx = -1
 		it.bitmapIdx = -1
 		it.bitset = 0
+		it.runIdx = -1
 		key = it.keys[it.keyIdx]
 		off = it.keys[it.keyIdx+1]
 		cont = it.bm.getContainer(off)
 		card = getCardinality(cont)
 	}
+	return key, cont, true
+}
+
+// NextMany fills the buffer with the following elements. Whole containers are decoded at once,
+// without any allocations. It returns the number of elements written to the buffer,
+// 0 if the iterator is exhausted.
+func (it *Iterator) NextMany(buf []uint64) int {
+	var n int
+	if it.peeked && len(buf) > 0 {
+		it.peeked = false
+		if !it.hasNext {
+			return 0
+		}
+		buf[n] = it.nextVal
+		n++
+	}
+
+	for n < len(buf) {
+		key, cont, ok := it.container()
+		if !ok {
+			break
+		}
+
+		card := getCardinality(cont)
+		switch cont[indexType] {
+		case typeArray:
+			vals := cont[int(startIdx)+it.contIdx+1 : int(startIdx)+card]
+			dst := buf[n:]
+			if len(vals) > len(dst) {
+				vals = vals[:len(dst)]
+			}
+			for i, x := range vals {
+				dst[i] = key | uint64(x)
+			}
+			it.contIdx += len(vals)
+			n += len(vals)
+		case typeBitmap:
+			for n < len(buf) && it.contIdx+1 < card {
+				for it.bitset == 0 {
+					it.bitmapIdx++
+					it.bitset = cont[int(startIdx)+it.bitmapIdx]
+				}
+				base := key | uint64(it.bitmapIdx*16)
+				for it.bitset != 0 && n < len(buf) {
+					msbIdx := bits.LeadingZeros16(it.bitset)
+					it.bitset ^= 1 << (15 - msbIdx)
+					buf[n] = base | uint64(msbIdx)
+					n++
+					it.contIdx++
+				}
+			}
+		case typeRun:
+			r := run(cont)
+			for n < len(buf) && it.contIdx+1 < card {
+				if it.runIdx < 0 || it.runVal == r.last(it.runIdx) {
+					it.runIdx++
+					it.runVal = r.start(it.runIdx)
+				} else {
+					it.runVal++
+				}
+				// Copy the rest of the run at once.
+				last := key | uint64(r.last(it.runIdx))
+				for x := key | uint64(it.runVal); ; x++ {
+					buf[n] = x
+					n++
+					it.contIdx++
+					if x == last || n == len(buf) {
+						it.runVal = uint16(x)
+						break
+					}
+				}
+			}
+		}
+	}
+	return n
+}
+
+// ReverseIterator returns elements of the bitmap in descending order.
+type ReverseIterator struct {
+	bm *Bitmap
+
+	keys   []uint64
+	keyIdx int
+
+	contIdx int
+
+	bitmapIdx int
+	bitset    uint16
+
+	runIdx int
+	runVal uint16
+
+	// peeked is set by HasNext, which has to fetch the next element in advance.
+	peeked  bool
+	hasNext bool
+	nextVal uint64
+}
+
+// bitmapWords is the number of uint16 words in the bitmap container.
+const bitmapWords = maxContainerSize - int(startIdx)
+
+func (bm *Bitmap) NewReverseIterator() *ReverseIterator {
+	it := &ReverseIterator{
+		bm:   bm,
+		keys: bm.keys[indexNodeStart : indexNodeStart+bm.keys.numKeys()*2],
+	}
+	it.keyIdx = max(len(it.keys)-2, 0)
+	it.resetContainer()
+	return it
+}
+
+func (it *ReverseIterator) resetContainer() {
+	it.contIdx = -1
+	it.bitmapIdx = bitmapWords
+	it.bitset = 0
+	it.runIdx = -1
+}
+
+// HasNext returns true if there are more elements to be returned by Next.
+func (it *ReverseIterator) HasNext() bool {
+	if !it.peeked {
+		it.nextVal, it.hasNext = it.advance()
+		it.peeked = true
+	}
+	return it.hasNext
+}
+
+// Next returns the next element of the bitmap, in descending order. Once the iterator is
+// exhausted, 0 is returned. Use HasNext to check whether there are more elements.
+func (it *ReverseIterator) Next() uint64 {
+	if it.peeked {
+		it.peeked = false
+		return it.nextVal
+	}
+	x, _ := it.advance()
+	return x
+}
+
+// NextMany fills the buffer with the following elements, in descending order. Whole containers
+// are decoded at once, without any allocations. It returns the number of elements written to
+// the buffer, 0 if the iterator is exhausted.
+func (it *ReverseIterator) NextMany(buf []uint64) int {
+	var n int
+	if it.peeked && len(buf) > 0 {
+		it.peeked = false
+		if !it.hasNext {
+			return 0
+		}
+		buf[n] = it.nextVal
+		n++
+	}
+
+	for n < len(buf) {
+		key, cont, ok := it.container()
+		if !ok {
+			break
+		}
+
+		card := getCardinality(cont)
+		switch cont[indexType] {
+		case typeArray:
+			// Elements not returned yet are the ones before end, copy them from the last one.
+			end := int(startIdx) + card - 1 - it.contIdx
+			vals := cont[int(startIdx):end]
+			dst := buf[n:]
+			if len(vals) > len(dst) {
+				vals = vals[len(vals)-len(dst):]
+			}
+			for i := range vals {
+				dst[i] = key | uint64(vals[len(vals)-1-i])
+			}
+			it.contIdx += len(vals)
+			n += len(vals)
+		case typeBitmap:
+			for n < len(buf) && it.contIdx+1 < card {
+				for it.bitset == 0 {
+					it.bitmapIdx--
+					it.bitset = cont[int(startIdx)+it.bitmapIdx]
+				}
+				// Bits are ordered from the most significant one, so the least significant set
+				// bit is the largest element of the word.
+				last := key | uint64(it.bitmapIdx*16+15)
+				for it.bitset != 0 && n < len(buf) {
+					tz := bits.TrailingZeros16(it.bitset)
+					it.bitset &^= 1 << tz
+					buf[n] = last - uint64(tz)
+					n++
+					it.contIdx++
+				}
+			}
+		case typeRun:
+			r := run(cont)
+			for n < len(buf) && it.contIdx+1 < card {
+				if it.runIdx < 0 {
+					it.runIdx = r.numRuns() - 1
+					it.runVal = r.last(it.runIdx)
+				} else if it.runVal == r.start(it.runIdx) {
+					it.runIdx--
+					it.runVal = r.last(it.runIdx)
+				} else {
+					it.runVal--
+				}
+				// Copy the rest of the run at once.
+				first := key | uint64(r.start(it.runIdx))
+				for x := key | uint64(it.runVal); ; x-- {
+					buf[n] = x
+					n++
+					it.contIdx++
+					if x == first || n == len(buf) {
+						it.runVal = uint16(x)
+						break
+					}
+				}
+			}
+		}
+	}
+	return n
+}
+
+// Seek moves the iterator, so the following call to Next returns the largest element <= x.
+// Skipped elements are not visited. The iterator can be moved both forward and backward.
+func (it *ReverseIterator) Seek(x uint64) {
+	it.peeked = false
+	it.resetContainer()
+
+	n := len(it.keys) / 2
+	if n == 0 {
+		return
+	}
+
+	// Find the last key <= key of x. Keys are followed by values, hence the indexes are doubled.
+	key := x & mask
+	lo, hi := 0, n
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if it.keys[2*mid] <= key {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	if lo == 0 {
+		// All elements are greater than x. Move the iterator past the first element.
+		it.keyIdx = 0
+		it.contIdx = getCardinality(it.bm.getContainer(it.keys[1])) - 1
+		return
+	}
+	it.keyIdx = 2 * (lo - 1)
+	if it.keys[it.keyIdx] == key {
+		it.seekInContainer(uint16(x))
+	}
+}
+
+// seekInContainer sets the state of the iterator, so the following call to advance returns
+// the largest element <= y of the current container.
+func (it *ReverseIterator) seekInContainer(y uint16) {
+	cont := it.bm.getContainer(it.keys[it.keyIdx+1])
+	card := getCardinality(cont)
+	switch cont[indexType] {
+	case typeArray:
+		a := array(cont)
+		idx := a.find(y)
+		if idx == card || a[int(startIdx)+idx] != y {
+			idx--
+		}
+		// All elements after idx are considered as already returned.
+		it.contIdx = card - idx - 2
+	case typeBitmap:
+		if y < math.MaxUint16 {
+			it.contIdx = bitmap(cont).rangeCardinality(y+1, math.MaxUint16) - 1
+		}
+		it.bitmapIdx = int(y >> 4)
+		it.bitset = cont[startIdx+y>>4] & (math.MaxUint16 << (15 - y&0xF))
+	case typeRun:
+		r := run(cont)
+		i := r.find(y)
+		if i == r.numRuns() || r.start(i) > y {
+			// y is not within a run, the largest element <= y is the last of the previous run.
+			if i == 0 {
+				it.contIdx = card - 1
+				return
+			}
+			i--
+			y = r.last(i)
+		}
+		it.contIdx = card - r.rank(y) - 2
+		if y == r.last(i) {
+			// Previous run is picked up on advance.
+			if i+1 < r.numRuns() {
+				it.runIdx = i + 1
+				it.runVal = r.start(i + 1)
+			}
+		} else {
+			it.runIdx = i
+			it.runVal = y + 1
+		}
+	}
+}
+
+// advance moves the iterator to the next element and returns it. If the iterator is exhausted,
+// false is returned.
+func (it *ReverseIterator) advance() (uint64, bool) {
+	key, cont, ok := it.container()
+	if !ok {
+		return 0, false
+	}
+	card := getCardinality(cont)
 
-	//  The above loop assures that we can do next in this container.
 	it.contIdx++
 	switch cont[indexType] {
 	case typeArray:
-		return key | uint64(cont[int(startIdx)+it.contIdx])
+		return key | uint64(cont[int(startIdx)+card-1-it.contIdx]), true
 	case typeBitmap:
-		// A bitmap container is an array of uint16s.
-		// If the container is bitmap, go to the index which has a non-zero value.
-		for it.bitset == 0 && it.bitmapIdx+1 < len(cont[startIdx:]) {
-			it.bitmapIdx++
+		for it.bitset == 0 && it.bitmapIdx > 0 {
+			it.bitmapIdx--
 			it.bitset = cont[int(startIdx)+it.bitmapIdx]
 		}
 		assert(it.bitset > 0)
 
-		// msbIdx is the index of most-significant bit. In this iteration we choose this set bit
-		// and make it zero.
-		msbIdx := uint16(bits.LeadingZeros16(it.bitset))
-		msb := 1 << (16 - msbIdx - 1)
-		it.bitset ^= uint16(msb)
-		return key | uint64(it.bitmapIdx*16+int(msbIdx))
+		// Bits are ordered from the most significant one, so the least significant set bit
+		// is the largest element of the word. Choose it and make it zero.
+		tz := bits.TrailingZeros16(it.bitset)
+		it.bitset &^= 1 << tz
+		return key | uint64(it.bitmapIdx*16+15-tz), true
+	case typeRun:
+		// Move to the previous run once the current one is exhausted.
+		r := run(cont)
+		if it.runIdx < 0 {
+			it.runIdx = r.numRuns() - 1
+			it.runVal = r.last(it.runIdx)
+		} else if it.runVal == r.start(it.runIdx) {
+			it.runIdx--
+			it.runVal = r.last(it.runIdx)
+		} else {
+			it.runVal--
+		}
+		return key | uint64(it.runVal), true
+	}
+	return 0, false
+}
+
+// All returns an iterator over the elements of the bitmap in ascending order.
+func (bm *Bitmap) All() iter.Seq[uint64] {
+	return func(yield func(uint64) bool) {
+		if bm == nil {
+			return
+		}
+		it := bm.NewIterator()
+		for x, ok := it.advance(); ok; x, ok = it.advance() {
+			if !yield(x) {
+				return
+			}
+		}
+	}
+}
+
+// Backward returns an iterator over the elements of the bitmap in descending order.
+func (bm *Bitmap) Backward() iter.Seq[uint64] {
+	return func(yield func(uint64) bool) {
+		if bm == nil {
+			return
+		}
+		it := bm.NewReverseIterator()
+		for x, ok := it.advance(); ok; x, ok = it.advance() {
+			if !yield(x) {
+				return
+			}
+		}
+	}
+}
+
+// Range returns an iterator over the elements in the range [lo, hi) in ascending order.
+func (bm *Bitmap) Range(lo, hi uint64) iter.Seq[uint64] {
+	return func(yield func(uint64) bool) {
+		bm.IterateRange(lo, hi, yield)
+	}
+}
+
+// IterateRange calls fn for every element in the range [lo, hi) in ascending order.
+// The iteration stops early, if fn returns false.
+func (bm *Bitmap) IterateRange(lo, hi uint64, fn func(x uint64) bool) {
+	if bm == nil || lo >= hi {
+		return
+	}
+	it := bm.NewIterator()
+	it.Seek(lo)
+	for x, ok := it.advance(); ok && x < hi; x, ok = it.advance() {
+		if !fn(x) {
+			return
+		}
+	}
+}
+
+// Containers returns an iterator over the non-empty containers of the bitmap, in ascending
+// order. It yields the key of each container, i.e. the upper 48 bits shared by its elements,
+// along with its cardinality.
+func (bm *Bitmap) Containers() iter.Seq2[uint64, int] {
+	return func(yield func(uint64, int) bool) {
+		if bm == nil {
+			return
+		}
+		for i := 0; i < bm.keys.numKeys(); i++ {
+			card := getCardinality(bm.getContainer(bm.keys.val(i)))
+			if card == 0 {
+				continue
+			}
+			if !yield(bm.keys.key(i), card) {
+				return
+			}
+		}
 	}
-	return 0
 }
 
 type ManyItr struct {
-	index int
-	arr   []uint64
+	it *Iterator
 }
 
-// TODO: See if this is needed, we should remove this
+// ManyIterator is kept for compatibility. Iterator.NextMany should be used instead.
 func (r *Bitmap) ManyIterator() *ManyItr {
 	return &ManyItr{
-		arr: r.ToArray(),
+		it: r.NewIterator(),
 	}
-
 }
 
 func (itr *ManyItr) NextMany(buf []uint64) int {
-	count := 0
-	for i := 0; i < len(buf); i++ {
-		if itr.index == len(itr.arr) {
-			break
+	return itr.it.NextMany(buf)
+}
+
+// container returns the key and the container, which has elements left to be iterated over.
+// If the current container is exhausted, the iterator moves to the preceding one.
+func (it *ReverseIterator) container() (uint64, []uint16, bool) {
+	if len(it.keys) == 0 {
+		return 0, nil, false
+	}
+
+	key := it.keys[it.keyIdx]
+	off := it.keys[it.keyIdx+1]
+	cont := it.bm.getContainer(off)
+	card := getCardinality(cont)
+
+	// Loop until we find a container on which next operation is possible.
+	for card == 0 || it.contIdx+1 >= card {
+		if it.keyIdx < 2 {
+			return 0, nil, false
 		}
-		buf[i] = itr.arr[itr.index]
-		itr.index++
-		count++
+		// jump by 2 because key is followed by a value
+		it.keyIdx -= 2
+		it.resetContainer()
+		key = it.keys[it.keyIdx]
+		off = it.keys[it.keyIdx+1]
+		cont = it.bm.getContainer(off)
+		card = getCardinality(cont)
 	}
-	return count
+	return key, cont, true
 }
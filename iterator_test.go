@@ -17,6 +17,7 @@
 package sroar
 
 import (
+	"math"
 	"math/rand"
 	"sort"
 	"testing"
@@ -105,6 +106,299 @@ func TestIteratorWithRemoveKeys(t *testing.T) {
 	require.Equal(t, 0, cnt)
 }
 
+func TestIteratorHasNext(t *testing.T) {
+	t.Run("with zero", func(t *testing.T) {
+		expected := []uint64{0, 1, 2, 100, 1 << 16, 1 << 20, 1<<20 + 1}
+		bm := NewBitmap()
+		bm.SetMany(expected)
+
+		var got []uint64
+		it := bm.NewIterator()
+		for it.HasNext() {
+			require.True(t, it.HasNext())
+			got = append(got, it.Next())
+		}
+		require.Equal(t, expected, got)
+		require.False(t, it.HasNext())
+		require.Equal(t, uint64(0), it.Next())
+	})
+
+	t.Run("only zero", func(t *testing.T) {
+		bm := NewBitmap()
+		bm.Set(0)
+
+		it := bm.NewIterator()
+		require.True(t, it.HasNext())
+		require.Equal(t, uint64(0), it.Next())
+		require.False(t, it.HasNext())
+	})
+
+	t.Run("mixed with Next", func(t *testing.T) {
+		bm := NewBitmap()
+		for i := uint64(0); i < 1000; i += 3 {
+			bm.Set(i)
+		}
+
+		it := bm.NewIterator()
+		for i := uint64(0); i < 1000; i += 3 {
+			if i%2 == 0 {
+				require.True(t, it.HasNext())
+			}
+			require.Equal(t, i, it.Next())
+		}
+		require.False(t, it.HasNext())
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		require.False(t, NewBitmap().NewIterator().HasNext())
+
+		bm := NewBitmap()
+		bm.Set(10)
+		bm.Remove(10)
+		require.False(t, bm.NewIterator().HasNext())
+	})
+
+	t.Run("range iterators", func(t *testing.T) {
+		bm := NewBitmap()
+		for i := uint64(0); i < 1e5; i++ {
+			bm.Set(i)
+		}
+
+		var cnt uint64
+		for _, it := range bm.NewRangeIterators(8) {
+			for it.HasNext() {
+				require.Equal(t, cnt, it.Next())
+				cnt++
+			}
+		}
+		require.Equal(t, uint64(1e5), cnt)
+	})
+}
+
+func TestIteratorSeek(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	maxX := uint64(6 << 16)
+
+	sparse := NewBitmap()
+	dense := NewBitmap()
+	for i := 0; i < 100_000; i++ {
+		x := rnd.Uint64() % maxX
+		dense.Set(x)
+		if i%50 == 0 {
+			sparse.Set(x)
+		}
+	}
+	runs := NewBitmap()
+	for x := uint64(0); x < maxX; x += 1000 {
+		runs.AddRange(x, x+100+x%300)
+	}
+	// leave empty container in the middle
+	withEmpty := sparse.Clone()
+	withEmpty.RemoveRange(2<<16, 3<<16)
+	withEmpty.Set(2 << 16)
+	withEmpty.Remove(2 << 16)
+
+	bitmaps := map[string]*Bitmap{
+		"arrays":     sparse,
+		"bitmaps":    dense,
+		"runs":       toRunBitmap(runs),
+		"with empty": withEmpty,
+	}
+
+	for name, bm := range bitmaps {
+		t.Run(name, func(t *testing.T) {
+			arr := bm.ToArray()
+			it := bm.NewIterator()
+
+			for i := 0; i < 500; i++ {
+				x := rnd.Uint64() % (maxX + 1000)
+				if i%10 == 0 {
+					// seek to existing element
+					x = arr[rnd.Intn(len(arr))]
+				}
+				idx := sort.Search(len(arr), func(i int) bool { return arr[i] >= x })
+
+				it.Seek(x)
+				for j := idx; j < idx+20 && j < len(arr); j++ {
+					require.True(t, it.HasNext())
+					require.Equal(t, arr[j], it.Next())
+				}
+				if idx+20 >= len(arr) {
+					require.False(t, it.HasNext())
+				}
+			}
+
+			it.Seek(0)
+			var got []uint64
+			for it.HasNext() {
+				got = append(got, it.Next())
+			}
+			require.Equal(t, arr, got)
+		})
+	}
+
+	t.Run("range iterators", func(t *testing.T) {
+		arr := dense.ToArray()
+		iters := dense.NewRangeIterators(3)
+
+		// each iterator stays within its own range of keys
+		iters[1].Seek(0)
+		first := iters[1].Next()
+		require.Equal(t, uint64(2<<16), first&mask)
+
+		iters[1].Seek(maxX)
+		require.False(t, iters[1].HasNext())
+
+		iters[2].Seek(arr[len(arr)-1])
+		require.Equal(t, arr[len(arr)-1], iters[2].Next())
+		require.False(t, iters[2].HasNext())
+	})
+
+	t.Run("empty bitmap", func(t *testing.T) {
+		it := NewBitmap().NewIterator()
+		it.Seek(100)
+		require.False(t, it.HasNext())
+	})
+}
+
+func TestReverseIterator(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	maxX := uint64(6 << 16)
+
+	sparse := NewBitmap()
+	dense := NewBitmap()
+	for i := 0; i < 100_000; i++ {
+		x := rnd.Uint64() % maxX
+		dense.Set(x)
+		if i%50 == 0 {
+			sparse.Set(x)
+		}
+	}
+	sparse.Set(0)
+	runs := NewBitmap()
+	for x := uint64(0); x < maxX; x += 1000 {
+		runs.AddRange(x, x+100+x%300)
+	}
+	withEmpty := sparse.Clone()
+	withEmpty.RemoveRange(2<<16, 3<<16)
+	withEmpty.Set(2 << 16)
+	withEmpty.Remove(2 << 16)
+
+	bitmaps := map[string]*Bitmap{
+		"arrays":     sparse,
+		"bitmaps":    dense,
+		"runs":       toRunBitmap(runs),
+		"with empty": withEmpty,
+	}
+
+	for name, bm := range bitmaps {
+		t.Run(name, func(t *testing.T) {
+			arr := bm.ToArray()
+			reversed := make([]uint64, len(arr))
+			for i, x := range arr {
+				reversed[len(arr)-1-i] = x
+			}
+
+			t.Run("next", func(t *testing.T) {
+				var got []uint64
+				it := bm.NewReverseIterator()
+				for it.HasNext() {
+					got = append(got, it.Next())
+				}
+				require.Equal(t, reversed, got)
+				require.Equal(t, uint64(0), it.Next())
+			})
+
+			t.Run("next many", func(t *testing.T) {
+				for _, size := range []int{1, 7, 333, 4096, 100_000} {
+					var got []uint64
+					buf := make([]uint64, size)
+					it := bm.NewReverseIterator()
+					require.True(t, it.HasNext())
+					for n := it.NextMany(buf); n > 0; n = it.NextMany(buf) {
+						got = append(got, buf[:n]...)
+					}
+					require.Equal(t, reversed, got, "buffer size %d", size)
+				}
+			})
+
+			t.Run("next many mixed with next and seek", func(t *testing.T) {
+				buf := make([]uint64, 13)
+				it := bm.NewReverseIterator()
+				var got []uint64
+				for i := 0; it.HasNext(); i++ {
+					if i%3 == 0 {
+						got = append(got, it.Next())
+						continue
+					}
+					n := it.NextMany(buf[:1+i%13])
+					got = append(got, buf[:n]...)
+				}
+				require.Equal(t, reversed, got)
+
+				for i := 0; i < 200; i++ {
+					x := arr[rnd.Intn(len(arr))] + uint64(rnd.Intn(3))
+					idx := sort.Search(len(arr), func(i int) bool { return arr[i] > x })
+					it.Seek(x)
+					n := it.NextMany(buf)
+					require.Equal(t, min(idx, len(buf)), n)
+					for j := 0; j < n; j++ {
+						require.Equal(t, arr[idx-1-j], buf[j])
+					}
+					if idx > n {
+						require.Equal(t, arr[idx-1-n], it.Next())
+					}
+				}
+			})
+
+			t.Run("seek", func(t *testing.T) {
+				it := bm.NewReverseIterator()
+				for i := 0; i < 500; i++ {
+					x := rnd.Uint64() % (maxX + 1000)
+					if i%10 == 0 {
+						x = arr[rnd.Intn(len(arr))]
+					}
+					// index of the first element > x in ascending order
+					idx := sort.Search(len(arr), func(i int) bool { return arr[i] > x })
+
+					it.Seek(x)
+					for j := idx - 1; j >= idx-20 && j >= 0; j-- {
+						require.True(t, it.HasNext())
+						require.Equal(t, arr[j], it.Next())
+					}
+					if idx-20 <= 0 {
+						require.False(t, it.HasNext())
+					}
+				}
+
+				it.Seek(math.MaxUint64)
+				require.Equal(t, arr[len(arr)-1], it.Next())
+			})
+		})
+	}
+
+	t.Run("empty bitmap", func(t *testing.T) {
+		it := NewBitmap().NewReverseIterator()
+		require.False(t, it.HasNext())
+		it.Seek(100)
+		require.False(t, it.HasNext())
+		require.Equal(t, 0, it.NextMany(make([]uint64, 10)))
+	})
+
+	t.Run("no allocations", func(t *testing.T) {
+		buf := make([]uint64, 1000)
+		for _, bm := range bitmaps {
+			allocs := testing.AllocsPerRun(10, func() {
+				it := bm.NewReverseIterator()
+				for it.NextMany(buf) > 0 {
+				}
+			})
+			// only the iterator itself is allocated
+			require.LessOrEqual(t, allocs, 1.0)
+		}
+	})
+}
+
 func TestManyIterator(t *testing.T) {
 	b := NewBitmap()
 	for i := 0; i < int(1e6); i++ {
@@ -126,6 +420,193 @@ func TestManyIterator(t *testing.T) {
 	}
 }
 
+func TestIteratorNextMany(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	maxX := uint64(6 << 16)
+
+	sparse := NewBitmap()
+	dense := NewBitmap()
+	for i := 0; i < 100_000; i++ {
+		x := rnd.Uint64() % maxX
+		dense.Set(x)
+		if i%50 == 0 {
+			sparse.Set(x)
+		}
+	}
+	sparse.Set(0)
+	runs := NewBitmap()
+	for x := uint64(0); x < maxX; x += 1000 {
+		runs.AddRange(x, x+100+x%300)
+	}
+	mixed := Or(sparse, dense)
+	mixed.Or(toRunBitmap(runs))
+	mixed.RemoveRange(2<<16, 3<<16)
+
+	bitmaps := map[string]*Bitmap{
+		"arrays":  sparse,
+		"bitmaps": dense,
+		"runs":    toRunBitmap(runs),
+		"mixed":   Or(Or(sparse, toRunBitmap(runs)), mixed),
+		"empty":   NewBitmap(),
+	}
+
+	for name, bm := range bitmaps {
+		t.Run(name, func(t *testing.T) {
+			arr := bm.ToArray()
+			for _, size := range []int{1, 7, 100, 4096, 100_000} {
+				buf := make([]uint64, size)
+				var got []uint64
+
+				it := bm.NewIterator()
+				for n := it.NextMany(buf); n > 0; n = it.NextMany(buf) {
+					got = append(got, buf[:n]...)
+				}
+				require.Equal(t, len(arr), len(got))
+				if len(arr) > 0 {
+					require.Equal(t, arr, got)
+				}
+			}
+
+			// NextMany mixed with Next, HasNext and Seek
+			if len(arr) > 1000 {
+				buf := make([]uint64, 13)
+				it := bm.NewIterator()
+				require.Equal(t, arr[0], it.Next())
+				require.True(t, it.HasNext())
+				require.Equal(t, 13, it.NextMany(buf))
+				require.Equal(t, arr[1:14], buf)
+				require.Equal(t, arr[14], it.Next())
+
+				it.Seek(arr[500])
+				require.Equal(t, 13, it.NextMany(buf))
+				require.Equal(t, arr[500:513], buf)
+				require.Equal(t, arr[513], it.Next())
+			}
+		})
+	}
+
+	t.Run("no allocations", func(t *testing.T) {
+		buf := make([]uint64, 1000)
+		allocs := testing.AllocsPerRun(10, func() {
+			it := dense.NewIterator()
+			for it.NextMany(buf) > 0 {
+			}
+		})
+		// only the iterator itself is allocated
+		require.LessOrEqual(t, allocs, 1.0)
+	})
+}
+
+func TestIteratorSeq(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	bm := NewBitmap()
+	bm.Set(0)
+	for i := 0; i < 20_000; i++ {
+		bm.Set(rnd.Uint64() % (4 << 16))
+	}
+	bm.AddRange(5<<16, 5<<16+5000)
+	bm.Or(toRunBitmap(runsBitmap(rnd, 20, 1000, 7<<16)))
+	bm.RemoveRange(6<<16, 7<<16)
+	arr := bm.ToArray()
+
+	t.Run("all", func(t *testing.T) {
+		var got []uint64
+		for x := range bm.All() {
+			got = append(got, x)
+		}
+		require.Equal(t, arr, got)
+	})
+
+	t.Run("backward", func(t *testing.T) {
+		var got []uint64
+		for x := range bm.Backward() {
+			got = append(got, x)
+		}
+		require.Equal(t, len(arr), len(got))
+		for i, x := range got {
+			require.Equal(t, arr[len(arr)-1-i], x)
+		}
+	})
+
+	t.Run("range", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			lo := rnd.Uint64() % (8 << 16)
+			hi := lo + rnd.Uint64()%(1<<17)
+			var expected []uint64
+			for _, x := range arr {
+				if x >= lo && x < hi {
+					expected = append(expected, x)
+				}
+			}
+			var got []uint64
+			for x := range bm.Range(lo, hi) {
+				got = append(got, x)
+			}
+			require.Equal(t, expected, got)
+		}
+		for range bm.Range(10, 10) {
+			t.Fatal("empty range should yield nothing")
+		}
+	})
+
+	t.Run("containers", func(t *testing.T) {
+		cards := make(map[uint64]int)
+		for _, x := range arr {
+			cards[x&mask]++
+		}
+		got := make(map[uint64]int)
+		prev := -1
+		for key, card := range bm.Containers() {
+			require.Greater(t, int(key), prev)
+			prev = int(key)
+			got[key] = card
+		}
+		require.Equal(t, cards, got)
+	})
+
+	t.Run("early termination", func(t *testing.T) {
+		var got []uint64
+		for x := range bm.All() {
+			if len(got) == 10 {
+				break
+			}
+			got = append(got, x)
+		}
+		require.Equal(t, arr[:10], got)
+
+		got = got[:0]
+		for x := range bm.Backward() {
+			got = append(got, x)
+			if len(got) == 3 {
+				break
+			}
+		}
+		require.Equal(t, []uint64{arr[len(arr)-1], arr[len(arr)-2], arr[len(arr)-3]}, got)
+
+		n := 0
+		for range bm.Containers() {
+			n++
+			break
+		}
+		require.Equal(t, 1, n)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		var nilBm *Bitmap
+		for _, bm := range []*Bitmap{NewBitmap(), nilBm} {
+			for range bm.All() {
+				t.Fatal("empty bitmap should yield nothing")
+			}
+			for range bm.Backward() {
+				t.Fatal("empty bitmap should yield nothing")
+			}
+			for range bm.Containers() {
+				t.Fatal("empty bitmap should yield nothing")
+			}
+		}
+	})
+}
+
 func BenchmarkIterator(b *testing.B) {
 	bm := NewBitmap()
 	for i := 0; i < int(1e5); i++ {
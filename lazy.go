@@ -0,0 +1,317 @@
+package sroar
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// LazyBitmap is a read-only bitmap stored in an io.ReaderAt, in the format returned by ToBuffer.
+// Only the keys node is read upfront, containers are read on demand and the most recently used
+// ones are kept in memory. It is meant for huge bitmaps of which only a few containers are
+// accessed. Use io.NewSectionReader for bitmaps not starting at the beginning of the reader.
+// LazyBitmap is safe for concurrent use.
+type LazyBitmap struct {
+	r    io.ReaderAt
+	keys node
+
+	mu sync.Mutex
+	// cache holds the recently used containers, the most recent at the front.
+	cache     *list.List
+	cached    map[uint64]*list.Element
+	cacheSize int
+	// cum[i] is the number of elements in the containers [0, i), built by the first Rank.
+	cum []int
+}
+
+type lazyContainer struct {
+	offset uint64
+	data   []uint16
+}
+
+// NewLazyBitmap reads the keys node from r and returns a LazyBitmap keeping at most cacheSize
+// containers in memory. At least one container is always kept. The keys node is validated,
+// containers are validated when read.
+func NewLazyBitmap(r io.ReaderAt, cacheSize int) (*LazyBitmap, error) {
+	if cacheSize < 1 {
+		cacheSize = 1
+	}
+	hdr := make([]uint16, 4)
+	n, err := r.ReadAt(toByteSlice(hdr), 0)
+	if n == 0 && err == io.EOF {
+		// Empty bitmaps are serialized to empty buffers, read a new bitmap instead.
+		r = bytes.NewReader(toByteSlice(NewBitmap().data))
+		n, err = r.ReadAt(toByteSlice(hdr), 0)
+	}
+	if err := checkRead(n, 2*len(hdr), err, "keys node header"); err != nil {
+		return nil, err
+	}
+
+	sz := toUint64Slice(hdr)[indexNodeSize]
+	if sz < uint64(calcInitialKeysLen(2)) || sz%4 != 0 {
+		return nil, errors.Wrapf(ErrInvalidBuffer, "invalid keys node size %d", sz)
+	}
+	// Node size comes from the input, so the node is not allocated upfront.
+	data, n, err := readUint16s(io.NewSectionReader(r, 0, int64(2*sz)), sz)
+	if err := checkRead(n, 2*int(sz), err, "keys node"); err != nil {
+		return nil, err
+	}
+	keys := node(toUint64Slice(data))
+	num := keys.numKeys()
+	if num < 1 || num >= keys.maxKeys() {
+		return nil, errors.Wrapf(ErrInvalidBuffer, "invalid number of keys %d, keys node fits %d",
+			num, keys.maxKeys())
+	}
+	if keys.key(0) != 0 {
+		return nil, errors.Wrapf(ErrInvalidBuffer, "first key %#x is not 0", keys.key(0))
+	}
+	for i := 0; i < num; i++ {
+		key := keys.key(i)
+		if key&^mask != 0 {
+			return nil, errors.Wrapf(ErrInvalidBuffer, "key %#x has lower bits set", key)
+		}
+		if i > 0 && key <= keys.key(i-1) {
+			return nil, errors.Wrapf(ErrInvalidBuffer,
+				"key %#x is not greater than previous key %#x", key, keys.key(i-1))
+		}
+		if keys.val(i) < sz {
+			return nil, errors.Wrapf(ErrInvalidBuffer, "offset %d of key %#x out of bounds",
+				keys.val(i), key)
+		}
+	}
+	return &LazyBitmap{
+		r:         r,
+		keys:      keys,
+		cache:     list.New(),
+		cached:    make(map[uint64]*list.Element),
+		cacheSize: cacheSize,
+	}, nil
+}
+
+// checkRead turns short reads of the expected number of bytes into ErrInvalidBuffer.
+func checkRead(n, expected int, err error, what string) error {
+	if n == expected {
+		return nil
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.Wrapf(ErrInvalidBuffer, "%s truncated: %d of %d bytes", what, n, expected)
+	}
+	return errors.Wrapf(err, "reading %s", what)
+}
+
+// container returns the container at the given offset, reading it if it is not cached.
+func (l *LazyBitmap) container(offset uint64) ([]uint16, error) {
+	l.mu.Lock()
+	if e, ok := l.cached[offset]; ok {
+		l.cache.MoveToFront(e)
+		l.mu.Unlock()
+		return e.Value.(*lazyContainer).data, nil
+	}
+	l.mu.Unlock()
+
+	c, err := l.readContainer(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.cached[offset]; ok {
+		// Read concurrently by another goroutine.
+		l.cache.MoveToFront(e)
+		return e.Value.(*lazyContainer).data, nil
+	}
+	l.cached[offset] = l.cache.PushFront(&lazyContainer{offset: offset, data: c})
+	for l.cache.Len() > l.cacheSize {
+		e := l.cache.Back()
+		l.cache.Remove(e)
+		delete(l.cached, e.Value.(*lazyContainer).offset)
+	}
+	return c, nil
+}
+
+func (l *LazyBitmap) readContainer(offset uint64) ([]uint16, error) {
+	var hdr [startIdx]uint16
+	n, err := l.r.ReadAt(toByteSlice(hdr[:]), int64(2*offset))
+	if err := checkRead(n, 2*len(hdr), err, "container header"); err != nil {
+		return nil, errors.Wrapf(err, "offset %d", offset)
+	}
+	size := hdr[indexSize]
+	if size < uint16(startIdx) {
+		return nil, errors.Wrapf(ErrInvalidBuffer, "size %d of container at offset %d too small",
+			size, offset)
+	}
+	c := make([]uint16, size)
+	n, err = l.r.ReadAt(toByteSlice(c), int64(2*offset))
+	if err := checkRead(n, 2*len(c), err, "container"); err != nil {
+		return nil, errors.Wrapf(err, "offset %d", offset)
+	}
+	if err := validateContainer(c); err != nil {
+		return nil, errors.Wrapf(err, "container at offset %d", offset)
+	}
+	return c, nil
+}
+
+// Contains returns true if x is in the bitmap. At most one container is read.
+func (l *LazyBitmap) Contains(x uint64) (bool, error) {
+	offset, has := l.keys.getValue(x & mask)
+	if !has {
+		return false, nil
+	}
+	c, err := l.container(offset)
+	if err != nil {
+		return false, err
+	}
+	y := uint16(x)
+	switch c[indexType] {
+	case typeArray:
+		return array(c).has(y), nil
+	case typeBitmap:
+		return bitmap(c).has(y), nil
+	case typeRun:
+		return run(c).has(y), nil
+	}
+	return false, nil
+}
+
+// Rank returns the number of elements less than x, or -1 if x is not in the bitmap, just like
+// Bitmap.Rank. The first call reads the headers of all the containers to get their cardinalities.
+func (l *LazyBitmap) Rank(x uint64) (int, error) {
+	key := x & mask
+	i := l.keys.search(key)
+	if i >= l.keys.numKeys() || l.keys.key(i) != key {
+		return -1, nil
+	}
+	c, err := l.container(l.keys.val(i))
+	if err != nil {
+		return 0, err
+	}
+	y := uint16(x)
+
+	var rank int
+	switch c[indexType] {
+	case typeArray:
+		rank = array(c).rank(y)
+	case typeBitmap:
+		rank = bitmap(c).rank(y)
+	case typeRun:
+		rank = run(c).rank(y)
+	}
+	if rank < 0 {
+		return -1, nil
+	}
+	cum, err := l.cardinalities()
+	if err != nil {
+		return 0, err
+	}
+	return cum[i] + rank, nil
+}
+
+// cardinalities returns the cumulative cardinalities of the containers, reading them from the
+// container headers if needed.
+func (l *LazyBitmap) cardinalities() ([]int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cum != nil {
+		return l.cum, nil
+	}
+	n := l.keys.numKeys()
+	cum := make([]int, n+1)
+	var hdr [startIdx]uint16
+	for i := 0; i < n; i++ {
+		offset := l.keys.val(i)
+		m, err := l.r.ReadAt(toByteSlice(hdr[:]), int64(2*offset))
+		if err := checkRead(m, 2*len(hdr), err, "container header"); err != nil {
+			return nil, errors.Wrapf(err, "offset %d", offset)
+		}
+		card := getCardinality(hdr[:])
+		if card > maxCardinality {
+			return nil, errors.Wrapf(ErrInvalidBuffer,
+				"cardinality %d of container at offset %d is too high", card, offset)
+		}
+		cum[i+1] = cum[i] + card
+	}
+	l.cum = cum
+	return cum, nil
+}
+
+// IterateRange calls fn for every element in the range [lo, hi) in ascending order. The
+// iteration stops early, if fn returns false. Only the containers intersecting the range are
+// read.
+func (l *LazyBitmap) IterateRange(lo, hi uint64, fn func(x uint64) bool) error {
+	if lo >= hi {
+		return nil
+	}
+	n := l.keys.numKeys()
+	for i := l.keys.search(lo & mask); i < n; i++ {
+		key := l.keys.key(i)
+		if key >= hi {
+			return nil
+		}
+		c, err := l.container(l.keys.val(i))
+		if err != nil {
+			return err
+		}
+		if getCardinality(c) == 0 {
+			continue
+		}
+
+		var y uint16
+		if key < lo {
+			y = uint16(lo)
+		}
+		for {
+			v, ok := nextValue(c, y)
+			if !ok {
+				break
+			}
+			x := key | uint64(v)
+			if x >= hi {
+				return nil
+			}
+			if !fn(x) {
+				return nil
+			}
+			if v == 0xFFFF {
+				break
+			}
+			y = v + 1
+		}
+	}
+	return nil
+}
+
+// And returns a new bitmap with the intersection of the LazyBitmap and bm. Only the containers
+// having their keys in bm are read.
+func (l *LazyBitmap) And(bm *Bitmap) (*Bitmap, error) {
+	res := NewBitmap()
+	if bm.IsEmpty() {
+		return res, nil
+	}
+
+	n := bm.keys.numKeys()
+	for i := 0; i < n; i++ {
+		key := bm.keys.key(i)
+		bc := bm.getContainer(bm.keys.val(i))
+		if getCardinality(bc) == 0 {
+			continue
+		}
+		offset, has := l.keys.getValue(key)
+		if !has {
+			continue
+		}
+		lc, err := l.container(offset)
+		if err != nil {
+			return nil, err
+		}
+		if c := containerAndAlt(lc, bc, nil, 0); len(c) > 0 && getCardinality(c) > 0 {
+			off := res.newContainerNoClr(uint16(len(c)))
+			copy(res.data[off:], c)
+			res.setKey(key, off)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,205 @@
+package sroar
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// countingReaderAt counts the bytes read through it.
+type countingReaderAt struct {
+	r    io.ReaderAt
+	read atomic.Int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func TestLazyBitmap(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	bm := NewBitmap()
+	for i := 0; i < 50_000; i++ {
+		bm.Set(rnd.Uint64() % (20 << 16))
+	}
+	for i := 0; i < 200; i++ {
+		bm.Set(rnd.Uint64() % (1 << 40))
+	}
+	bm.Or(toRunBitmap(runsBitmap(rnd, 50, 5000, 40<<16)))
+	arr := bm.ToArray()
+	buf := bm.ToBuffer()
+
+	t.Run("contains and rank", func(t *testing.T) {
+		lazy, err := NewLazyBitmap(bytes.NewReader(buf), 4)
+		require.NoError(t, err)
+		for i := 0; i < 2000; i++ {
+			x := arr[rnd.Intn(len(arr))]
+			if i%2 == 1 {
+				x = rnd.Uint64() % (1 << 41)
+			}
+			has, err := lazy.Contains(x)
+			require.NoError(t, err)
+			require.Equal(t, bm.Contains(x), has, "x: %d", x)
+
+			if has {
+				rank, err := lazy.Rank(x)
+				require.NoError(t, err)
+				require.Equal(t, bm.Rank(x), rank, "x: %d", x)
+			}
+		}
+		require.LessOrEqual(t, lazy.cache.Len(), 4)
+		require.Equal(t, lazy.cache.Len(), len(lazy.cached))
+	})
+
+	t.Run("iterate range", func(t *testing.T) {
+		lazy, err := NewLazyBitmap(bytes.NewReader(buf), 4)
+		require.NoError(t, err)
+		ranges := [][2]uint64{
+			{0, 1 << 60}, {0, 0}, {100, 10}, {1 << 16, 3 << 16}, {12345, 5<<16 + 17},
+			{arr[100], arr[100] + 1}, {arr[len(arr)-1], arr[len(arr)-1] + 1},
+		}
+		for i := 0; i < 50; i++ {
+			lo := rnd.Uint64() % (40 << 16)
+			ranges = append(ranges, [2]uint64{lo, lo + rnd.Uint64()%(3<<16)})
+		}
+		for _, r := range ranges {
+			var expected, actual []uint64
+			bm.IterateRange(r[0], r[1], func(x uint64) bool {
+				expected = append(expected, x)
+				return true
+			})
+			require.NoError(t, lazy.IterateRange(r[0], r[1], func(x uint64) bool {
+				actual = append(actual, x)
+				return true
+			}))
+			require.Equal(t, expected, actual, "range [%d, %d)", r[0], r[1])
+		}
+
+		var count int
+		require.NoError(t, lazy.IterateRange(0, 1<<60, func(x uint64) bool {
+			count++
+			return count < 10
+		}))
+		require.Equal(t, 10, count)
+	})
+
+	t.Run("and", func(t *testing.T) {
+		lazy, err := NewLazyBitmap(bytes.NewReader(buf), 4)
+		require.NoError(t, err)
+		other := NewBitmap()
+		for i := 0; i < 10_000; i++ {
+			other.Set(rnd.Uint64() % (45 << 16))
+		}
+		other.Or(toRunBitmap(runsBitmap(rnd, 20, 5000, 45<<16)))
+
+		for _, b := range []*Bitmap{other, bm, NewBitmap(), nil} {
+			res, err := lazy.And(b)
+			require.NoError(t, err)
+			require.Equal(t, And(bm, b).ToArray(), res.ToArray())
+		}
+	})
+
+	t.Run("reads only needed containers", func(t *testing.T) {
+		r := &countingReaderAt{r: bytes.NewReader(buf)}
+		lazy, err := NewLazyBitmap(r, 2)
+		require.NoError(t, err)
+		keysRead := r.read.Load()
+		require.Equal(t, int64(8+8*len(bm.keys)), keysRead)
+
+		has, err := lazy.Contains(arr[0])
+		require.NoError(t, err)
+		require.True(t, has)
+		read := r.read.Load()
+		require.LessOrEqual(t, read-keysRead, int64(2*maxContainerSize+8))
+
+		// Cached container is not read again.
+		has, err = lazy.Contains(arr[1])
+		require.NoError(t, err)
+		require.True(t, has)
+		require.Equal(t, read, r.read.Load())
+		require.Less(t, int(r.read.Load()), len(buf)/4)
+	})
+
+	t.Run("concurrent use", func(t *testing.T) {
+		lazy, err := NewLazyBitmap(bytes.NewReader(buf), 3)
+		require.NoError(t, err)
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(seed int64) {
+				defer wg.Done()
+				rnd := rand.New(rand.NewSource(seed))
+				for i := 0; i < 500; i++ {
+					x := arr[rnd.Intn(len(arr))]
+					has, err := lazy.Contains(x)
+					require.NoError(t, err)
+					require.True(t, has)
+					rank, err := lazy.Rank(x)
+					require.NoError(t, err)
+					require.Equal(t, bm.Rank(x), rank)
+				}
+			}(int64(g))
+		}
+		wg.Wait()
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		lazy, err := NewLazyBitmap(bytes.NewReader(nil), 0)
+		require.NoError(t, err)
+		has, err := lazy.Contains(0)
+		require.NoError(t, err)
+		require.False(t, has)
+		rank, err := lazy.Rank(0)
+		require.NoError(t, err)
+		require.Equal(t, -1, rank)
+		res, err := lazy.And(bm)
+		require.NoError(t, err)
+		require.True(t, res.IsEmpty())
+		require.NoError(t, lazy.IterateRange(0, 1<<60, func(uint64) bool {
+			t.Fatal("no elements expected")
+			return false
+		}))
+	})
+
+	t.Run("invalid buffers", func(t *testing.T) {
+		_, err := NewLazyBitmap(bytes.NewReader(buf[:5]), 1)
+		require.ErrorIs(t, err, ErrInvalidBuffer)
+		_, err = NewLazyBitmap(bytes.NewReader(buf[:8*len(bm.keys)-8]), 1)
+		require.ErrorIs(t, err, ErrInvalidBuffer)
+
+		hugeNode := append([]byte(nil), buf...)
+		hugeNode[6] = 0xFF
+		_, err = NewLazyBitmap(bytes.NewReader(hugeNode), 1)
+		require.ErrorIs(t, err, ErrInvalidBuffer)
+
+		// Containers are validated when read. Truncate the buffer in the middle of the container
+		// placed last.
+		var lastKey, lastOff uint64
+		for i := 0; i < bm.keys.numKeys(); i++ {
+			if off := bm.keys.val(i); off > lastOff {
+				lastKey, lastOff = bm.keys.key(i), off
+			}
+		}
+		lazy, err := NewLazyBitmap(bytes.NewReader(buf[:2*lastOff+6]), 1)
+		require.NoError(t, err)
+		_, err = lazy.Contains(lastKey)
+		require.ErrorIs(t, err, ErrInvalidBuffer)
+		require.ErrorIs(t, lazy.IterateRange(0, 1<<60, func(uint64) bool { return true }),
+			ErrInvalidBuffer)
+
+		corrupted := append([]byte(nil), buf...)
+		off := bm.keys.val(0)
+		corrupted[2*off+4] = 0xFF // cardinality of the container for key 0
+		lazy, err = NewLazyBitmap(bytes.NewReader(corrupted), 1)
+		require.NoError(t, err)
+		_, err = lazy.Contains(0)
+		require.ErrorIs(t, err, ErrInvalidBuffer)
+	})
+}
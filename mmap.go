@@ -0,0 +1,68 @@
+package sroar
+
+import (
+	"github.com/pkg/errors"
+)
+
+// FromReadOnlyMapping returns a read-only bitmap corresponding to the given buffer, which is
+// usually memory mapped by the caller. Any modification of the bitmap panics with ErrReadOnly.
+// The buffer is not unmapped by Close, it has to stay valid as long as the bitmap is used.
+func FromReadOnlyMapping(data []byte) (*Bitmap, error) {
+	if len(data)%2 != 0 {
+		return nil, errors.Wrapf(ErrInvalidBuffer, "odd buffer length %d", len(data))
+	}
+	bm := NewBitmap()
+	if len(data) >= 8 {
+		sz := toUint64Slice(byteTo16SliceUnsafe(data[:8]))[indexNodeSize]
+		if sz > uint64(len(data)/2) {
+			return nil, errors.Wrapf(ErrInvalidBuffer, "invalid keys node size %d", sz)
+		}
+		bm = FromBuffer(data)
+	}
+	bm.readOnly = true
+	return bm, nil
+}
+
+// OpenMapped maps the file at the given path into memory and returns a read-only bitmap backed
+// by it. The file has to hold a buffer returned by ToBuffer, it is validated before the bitmap is
+// built and ErrInvalidBuffer is returned for corrupted files. Any modification of the bitmap
+// panics with ErrReadOnly. Close has to be called to unmap the file.
+func OpenMapped(path string) (*Bitmap, error) {
+	data, err := mmapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = Validate(data)
+	var bm *Bitmap
+	if err == nil {
+		bm, err = FromReadOnlyMapping(data)
+	}
+	if err != nil {
+		if data != nil {
+			munmap(data)
+		}
+		return nil, err
+	}
+	bm.mapping = data
+	return bm, nil
+}
+
+// Close unmaps the file backing the bitmap returned by OpenMapped. Once closed, the bitmap is
+// empty, unless it was already copied by MakeWritable or a modification after Thaw. Slices and
+// iterators obtained from the bitmap before must not be used anymore. Close is a no-op for bitmaps
+// not backed by a file.
+func (ra *Bitmap) Close() error {
+	if ra == nil || ra.mapping == nil {
+		return nil
+	}
+	mapping := ra.mapping
+	ra.mapping = nil
+	if ra.readOnly || ra.copyOnWrite {
+		// Bitmap still refers to the mapping.
+		empty := NewBitmap()
+		ra.data, ra.keys, ra._ptr = empty.data, empty.keys, nil
+		ra.copyOnWrite = false
+		ra.invalidateRankIndex()
+	}
+	return munmap(mapping)
+}
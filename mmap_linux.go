@@ -0,0 +1,41 @@
+//go:build linux
+
+package sroar
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// mmapFile maps the whole file read-only into memory. Nil is returned for empty files, as
+// those can not be mapped.
+func mmapFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size == 0 {
+		return nil, nil
+	}
+	if int64(int(size)) != size {
+		return nil, errors.Errorf("file %s of %d bytes is too large to be mapped", path, size)
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, errors.Wrapf(err, "mapping file %s", path)
+	}
+	return data, nil
+}
+
+func munmap(data []byte) error {
+	return errors.Wrap(syscall.Munmap(data), "unmapping file")
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package sroar
+
+import (
+	"github.com/pkg/errors"
+)
+
+func mmapFile(path string) ([]byte, error) {
+	return nil, errors.New("memory mapped bitmaps are only supported on linux")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,135 @@
+//go:build linux
+
+package sroar
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenMapped(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	src := NewBitmap()
+	for i := 0; i < 50_000; i++ {
+		src.Set(rnd.Uint64() % (20 << 16))
+	}
+	src.Or(toRunBitmap(runsBitmap(rnd, 50, 5000, 40<<16)))
+	arr := src.ToArray()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bitmap")
+	require.NoError(t, os.WriteFile(path, src.ToBuffer(), 0o600))
+
+	t.Run("read", func(t *testing.T) {
+		bm, err := OpenMapped(path)
+		require.NoError(t, err)
+		defer bm.Close()
+
+		require.True(t, bm.IsReadOnly())
+		require.Equal(t, arr, bm.ToArray())
+		require.Equal(t, len(arr)/2, bm.Rank(arr[len(arr)/2]))
+		require.True(t, bm.Contains(arr[10]))
+		require.True(t, src.Equals(bm))
+		require.Equal(t, AndCardinality(src, bm), len(arr))
+		assertMatches(t, src, And(bm, src), Or(bm, NewBitmap()))
+
+		// Clones are writable.
+		clone := bm.Clone()
+		require.False(t, clone.IsReadOnly())
+		clone.Set(1 << 40)
+		clone.RemoveRange(0, 1<<20)
+		require.Equal(t, arr, bm.ToArray())
+	})
+
+	t.Run("mutators panic", func(t *testing.T) {
+		bm, err := OpenMapped(path)
+		require.NoError(t, err)
+		defer bm.Close()
+
+		for name, mutate := range readOnlyMutators {
+			require.PanicsWithValuef(t, ErrReadOnly, func() { mutate(bm) }, "method %s", name)
+		}
+		require.Equal(t, arr, bm.ToArray())
+
+		onDisk, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, src.ToBuffer(), onDisk)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		bm, err := OpenMapped(path)
+		require.NoError(t, err)
+		require.NoError(t, bm.Close())
+		require.True(t, bm.IsEmpty())
+		require.True(t, bm.IsReadOnly())
+		require.NoError(t, bm.Close())
+
+		// Close is a no-op for bitmaps not backed by a file.
+		require.NoError(t, src.Close())
+		require.Equal(t, arr, src.ToArray())
+	})
+
+	t.Run("read into thawed bitmap", func(t *testing.T) {
+		bm, err := OpenMapped(path)
+		require.NoError(t, err)
+		bm.Thaw()
+
+		other := FromSortedList([]uint64{1, 2, 3})
+		_, err = bm.ReadFrom(bytes.NewReader(other.ToBufferFramed()))
+		require.NoError(t, err)
+		require.Nil(t, bm.mapping)
+		require.NoError(t, bm.Close())
+		require.Equal(t, []uint64{1, 2, 3}, bm.ToArray())
+		bm.Set(4)
+		require.Equal(t, []uint64{1, 2, 3, 4}, bm.ToArray())
+	})
+
+	t.Run("empty file", func(t *testing.T) {
+		empty := filepath.Join(dir, "empty")
+		require.NoError(t, os.WriteFile(empty, nil, 0o600))
+		bm, err := OpenMapped(empty)
+		require.NoError(t, err)
+		require.True(t, bm.IsEmpty())
+		require.True(t, bm.IsReadOnly())
+		require.NoError(t, bm.Close())
+	})
+
+	t.Run("invalid files", func(t *testing.T) {
+		_, err := OpenMapped(filepath.Join(dir, "missing"))
+		require.Error(t, err)
+
+		odd := filepath.Join(dir, "odd")
+		require.NoError(t, os.WriteFile(odd, []byte{1, 2, 3}, 0o600))
+		_, err = OpenMapped(odd)
+		require.ErrorIs(t, err, ErrInvalidBuffer)
+
+		truncated := filepath.Join(dir, "truncated")
+		require.NoError(t, os.WriteFile(truncated, src.ToBuffer()[:16], 0o600))
+		_, err = OpenMapped(truncated)
+		require.ErrorIs(t, err, ErrInvalidBuffer)
+
+		buf := src.ToBufferWithCopy()
+		off := src.keys.val(1)
+		buf[2*(int(off)+indexType)] = 9
+		corrupted := filepath.Join(dir, "corrupted")
+		require.NoError(t, os.WriteFile(corrupted, buf, 0o600))
+		_, err = OpenMapped(corrupted)
+		require.ErrorIs(t, err, ErrInvalidBuffer)
+	})
+
+	t.Run("from read-only mapping", func(t *testing.T) {
+		buf := src.ToBufferWithCopy()
+		bm, err := FromReadOnlyMapping(buf)
+		require.NoError(t, err)
+		require.True(t, bm.IsReadOnly())
+		require.Equal(t, arr, bm.ToArray())
+		require.PanicsWithValue(t, ErrReadOnly, func() { bm.Set(1 << 40) })
+		require.NoError(t, bm.Close())
+		require.Equal(t, arr, bm.ToArray())
+	})
+}
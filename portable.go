@@ -0,0 +1,387 @@
+package sroar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/bits"
+
+	"github.com/pkg/errors"
+)
+
+// Portable format is the 64-bit serialization format shared by Roaring implementations
+// (https://github.com/RoaringBitmap/RoaringFormatSpec). Elements are grouped by their upper
+// 32 bits into 32-bit Roaring bitmaps:
+//
+//	numBuckets uint64
+//	numBuckets times:
+//		key    uint32, upper 32 bits of the elements
+//		bitmap 32-bit Roaring bitmap holding lower 32 bits of the elements
+//
+// All values are little endian.
+const (
+	portableCookie      = 12347
+	portableCookieNoRun = 12346
+
+	// portableNoOffsetThreshold is the number of containers, below which the offsets are not
+	// written for bitmaps having run containers.
+	portableNoOffsetThreshold = 4
+	// portableArrayMaxCard is the maximum cardinality of the array containers. Non-run containers
+	// with higher cardinalities are bitmap containers.
+	portableArrayMaxCard = 4096
+	portableBitmapBytes  = 8192
+)
+
+// ToPortableBuffer serializes the bitmap into the portable 64-bit Roaring format, which can be
+// read by other Roaring implementations.
+func (ra *Bitmap) ToPortableBuffer() []byte {
+	buf := make([]byte, 8, 8+ra.LenInBytes())
+	if ra == nil {
+		return buf
+	}
+
+	var numBuckets uint64
+	var keys []uint16
+	var containers [][]uint16
+	n := ra.keys.numKeys()
+	for i := 0; i < n; {
+		hi := ra.keys.key(i) >> 32
+		keys, containers = keys[:0], containers[:0]
+		for ; i < n && ra.keys.key(i)>>32 == hi; i++ {
+			c := ra.getContainer(ra.keys.val(i))
+			if getCardinality(c) == 0 {
+				continue
+			}
+			keys = append(keys, uint16(ra.keys.key(i)>>16))
+			containers = append(containers, c)
+		}
+		if len(containers) == 0 {
+			continue
+		}
+		numBuckets++
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(hi))
+		buf = appendPortable32(buf, keys, containers)
+	}
+	binary.LittleEndian.PutUint64(buf[:8], numBuckets)
+	return buf
+}
+
+// WritePortable writes the bitmap in the portable 64-bit Roaring format to w.
+func (ra *Bitmap) WritePortable(w io.Writer) (int64, error) {
+	n, err := w.Write(ra.ToPortableBuffer())
+	return int64(n), err
+}
+
+// appendPortable32 appends 32-bit Roaring bitmap consisting of the given non-empty containers.
+func appendPortable32(buf []byte, keys []uint16, containers [][]uint16) []byte {
+	start := len(buf)
+	size := len(containers)
+
+	var hasRun bool
+	for _, c := range containers {
+		if c[indexType] == typeRun {
+			hasRun = true
+			break
+		}
+	}
+
+	if hasRun {
+		buf = binary.LittleEndian.AppendUint32(buf, portableCookie|uint32(size-1)<<16)
+		flags := make([]byte, (size+7)/8)
+		for i, c := range containers {
+			if c[indexType] == typeRun {
+				flags[i/8] |= 1 << (i % 8)
+			}
+		}
+		buf = append(buf, flags...)
+	} else {
+		buf = binary.LittleEndian.AppendUint32(buf, portableCookieNoRun)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(size))
+	}
+
+	for i, c := range containers {
+		buf = binary.LittleEndian.AppendUint16(buf, keys[i])
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(getCardinality(c)-1))
+	}
+
+	var offsets int
+	if !hasRun || size >= portableNoOffsetThreshold {
+		offsets = len(buf)
+		buf = append(buf, make([]byte, 4*size)...)
+	}
+
+	for i, c := range containers {
+		if offsets > 0 {
+			binary.LittleEndian.PutUint32(buf[offsets+4*i:], uint32(len(buf)-start))
+		}
+		buf = appendPortableContainer(buf, c)
+	}
+	return buf
+}
+
+func appendPortableContainer(buf []byte, c []uint16) []byte {
+	card := getCardinality(c)
+	switch {
+	case c[indexType] == typeRun:
+		r := run(c)
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(r.numRuns()))
+		for i := 0; i < r.numRuns(); i++ {
+			buf = binary.LittleEndian.AppendUint16(buf, r.start(i))
+			buf = binary.LittleEndian.AppendUint16(buf, r.last(i)-r.start(i))
+		}
+
+	case card <= portableArrayMaxCard:
+		var vals []uint16
+		if c[indexType] == typeArray {
+			vals = c[startIdx : int(startIdx)+card]
+		} else {
+			vals = bitmap(c).all()
+		}
+		for _, x := range vals {
+			buf = binary.LittleEndian.AppendUint16(buf, x)
+		}
+
+	default:
+		if c[indexType] == typeArray {
+			c = array(c).toBitmapContainer(nil)
+		}
+		// Bits of sroar bitmap containers are ordered from the most significant one, while
+		// portable bitmaps are ordered from the least significant one.
+		data := c[startIdx:]
+		for i := 0; i < len(data); i += 4 {
+			w := uint64(bits.Reverse16(data[i])) |
+				uint64(bits.Reverse16(data[i+1]))<<16 |
+				uint64(bits.Reverse16(data[i+2]))<<32 |
+				uint64(bits.Reverse16(data[i+3]))<<48
+			buf = binary.LittleEndian.AppendUint64(buf, w)
+		}
+	}
+	return buf
+}
+
+// FromPortableBuffer reads the bitmap serialized in the portable 64-bit Roaring format.
+// The input is validated, so it can come from untrusted sources. Run containers are kept,
+// unless they have too many runs to fit a run container. The buffer is not referenced by
+// the returned bitmap.
+func FromPortableBuffer(buf []byte) (*Bitmap, error) {
+	return ReadPortable(bytes.NewReader(buf))
+}
+
+// ReadPortable reads the bitmap serialized in the portable 64-bit Roaring format from r.
+// It does not read beyond the end of the bitmap.
+func ReadPortable(r io.Reader) (*Bitmap, error) {
+	pr := portableReader{r: r}
+	numBuckets := pr.uint64()
+
+	// Container for key = 0 is always present.
+	keys := []uint64{0}
+	containers := [][]uint16{{uint16(startIdx), typeArray, 0, 0}}
+	sizeContainers := int(startIdx)
+	var last uint64
+	var hasLast bool
+	for b := uint64(0); b < numBuckets && pr.err == nil; b++ {
+		hi := uint64(pr.uint32()) << 32
+		bucketKeys, bucketContainers := pr.portable32()
+		for i, c := range bucketContainers {
+			key := hi | uint64(bucketKeys[i])<<16
+			if hasLast && key <= last {
+				pr.fail("key %#x is not greater than previous key %#x", key, last)
+				break
+			}
+			last, hasLast = key, true
+			sizeContainers += len(c)
+			if key == 0 {
+				sizeContainers -= len(containers[0])
+				containers[0] = c
+				continue
+			}
+			keys = append(keys, key)
+			containers = append(containers, c)
+		}
+	}
+	if pr.err != nil {
+		return nil, pr.err
+	}
+	return fromContainers(keys, containers, sizeContainers), nil
+}
+
+// portableReader reads the portable format, keeping the first error encountered.
+type portableReader struct {
+	r   io.Reader
+	buf [8]byte
+	err error
+}
+
+func (pr *portableReader) fail(format string, args ...interface{}) {
+	if pr.err == nil {
+		pr.err = errors.Wrapf(ErrInvalidBuffer, format, args...)
+	}
+}
+
+func (pr *portableReader) read(buf []byte) []byte {
+	if pr.err != nil {
+		return nil
+	}
+	if _, err := io.ReadFull(pr.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		pr.err = errors.Wrap(err, "reading portable bitmap")
+		return nil
+	}
+	return buf
+}
+
+func (pr *portableReader) uint16() uint16 {
+	if b := pr.read(pr.buf[:2]); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (pr *portableReader) uint32() uint32 {
+	if b := pr.read(pr.buf[:4]); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (pr *portableReader) uint64() uint64 {
+	if b := pr.read(pr.buf[:8]); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+// portable32 reads 32-bit Roaring bitmap. It returns the keys and the sroar containers.
+func (pr *portableReader) portable32() ([]uint16, [][]uint16) {
+	var size int
+	var runFlags []byte
+	switch cookie := pr.uint32(); {
+	case pr.err != nil:
+		return nil, nil
+	case cookie&0xFFFF == portableCookie:
+		size = int(cookie>>16) + 1
+		runFlags = pr.read(make([]byte, (size+7)/8))
+	case cookie == portableCookieNoRun:
+		size = int(pr.uint32())
+		if size > 1<<16 {
+			pr.fail("invalid number of containers %d", size)
+			return nil, nil
+		}
+	default:
+		pr.fail("invalid cookie %#x", cookie)
+		return nil, nil
+	}
+
+	header := pr.read(make([]byte, 4*size))
+	if runFlags == nil || size >= portableNoOffsetThreshold {
+		// Containers are read in order, so the offsets are not needed.
+		pr.read(make([]byte, 4*size))
+	}
+	if pr.err != nil {
+		return nil, nil
+	}
+
+	keys := make([]uint16, size)
+	containers := make([][]uint16, size)
+	for i := 0; i < size && pr.err == nil; i++ {
+		keys[i] = binary.LittleEndian.Uint16(header[4*i:])
+		if i > 0 && keys[i] <= keys[i-1] {
+			pr.fail("container key %#x is not greater than previous key %#x", keys[i], keys[i-1])
+			break
+		}
+		card := int(binary.LittleEndian.Uint16(header[4*i+2:])) + 1
+		switch {
+		case runFlags != nil && runFlags[i/8]&(1<<(i%8)) != 0:
+			containers[i] = pr.runContainer(card)
+		case card <= portableArrayMaxCard:
+			containers[i] = pr.arrayContainer(card)
+		default:
+			containers[i] = pr.bitmapContainer(card)
+		}
+	}
+	return keys, containers
+}
+
+func (pr *portableReader) arrayContainer(card int) []uint16 {
+	b := pr.read(make([]byte, 2*card))
+	if b == nil {
+		return nil
+	}
+	c := make([]uint16, int(startIdx)+card)
+	c[indexSize] = uint16(len(c))
+	c[indexType] = typeArray
+	setCardinality(c, card)
+	for i := 0; i < card; i++ {
+		x := binary.LittleEndian.Uint16(b[2*i:])
+		if i > 0 && x <= c[int(startIdx)+i-1] {
+			pr.fail("array elements %d and %d are not sorted", c[int(startIdx)+i-1], x)
+			return nil
+		}
+		c[int(startIdx)+i] = x
+	}
+	return c
+}
+
+func (pr *portableReader) bitmapContainer(card int) []uint16 {
+	b := pr.read(make([]byte, portableBitmapBytes))
+	if b == nil {
+		return nil
+	}
+	c := make([]uint16, maxContainerSize)
+	c[indexSize] = maxContainerSize
+	c[indexType] = typeBitmap
+	data := c[startIdx:]
+	var actual int
+	for i := 0; i < len(data); i += 4 {
+		w := binary.LittleEndian.Uint64(b[2*i:])
+		actual += bits.OnesCount64(w)
+		data[i] = bits.Reverse16(uint16(w))
+		data[i+1] = bits.Reverse16(uint16(w >> 16))
+		data[i+2] = bits.Reverse16(uint16(w >> 32))
+		data[i+3] = bits.Reverse16(uint16(w >> 48))
+	}
+	if actual != card {
+		pr.fail("bitmap cardinality %d, expected %d", actual, card)
+		return nil
+	}
+	setCardinality(c, card)
+	return c
+}
+
+func (pr *portableReader) runContainer(card int) []uint16 {
+	numRuns := int(pr.uint16())
+	b := pr.read(make([]byte, 4*numRuns))
+	if b == nil {
+		return nil
+	}
+	c := make([]uint16, runSize(numRuns))
+	c[indexType] = typeRun
+	r := run(c)
+	r.setNumRuns(numRuns)
+	var actual int
+	for i := 0; i < numRuns; i++ {
+		start := binary.LittleEndian.Uint16(b[4*i:])
+		length := binary.LittleEndian.Uint16(b[4*i+2:])
+		// Runs have to be sorted and not adjacent.
+		if int(start)+int(length) > 0xFFFF || (i > 0 && int(start) <= int(r.last(i-1))+1) {
+			pr.fail("run [%d, %d] is not valid", start, int(start)+int(length))
+			return nil
+		}
+		r.setRun(i, start, start+length)
+		actual += int(length) + 1
+	}
+	if actual != card {
+		pr.fail("run cardinality %d, expected %d", actual, card)
+		return nil
+	}
+	setCardinality(c, card)
+
+	if len(c) > maxContainerSize {
+		// Too many runs to fit a run container.
+		return r.toBitmapContainer(nil)
+	}
+	c[indexSize] = uint16(len(c))
+	return c
+}
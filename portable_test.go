@@ -0,0 +1,188 @@
+package sroar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/stretchr/testify/require"
+)
+
+func portableTestBitmaps(rnd *rand.Rand) map[string]*Bitmap {
+	sparse := NewBitmap()
+	dense := NewBitmap()
+	for i := 0; i < 50_000; i++ {
+		x := rnd.Uint64() % (20 << 16)
+		dense.Set(x)
+		if i%100 == 0 {
+			sparse.Set(x)
+		}
+	}
+	runs := toRunBitmap(runsBitmap(rnd, 50, 5000, 20<<16))
+
+	mixed := Or(Or(sparse, runs), dense.SubBitmap(3<<16, 5<<16))
+	// Elements spread over multiple 32-bit buckets.
+	for _, x := range []uint64{1 << 32, 1<<32 + 1, 5<<32 + 7<<16, 1 << 48, math.MaxUint64} {
+		mixed.Set(x)
+	}
+	mixed.AddRange(7<<32, 7<<32+100_000)
+	// Empty container in between.
+	mixed.Set(9 << 32)
+	mixed.Remove(9 << 32)
+
+	// Run container with too many runs to fit a run container in sroar.
+	alternating := NewBitmap()
+	for x := uint64(0); x < 1<<16; x += 2 {
+		alternating.Set(x)
+	}
+
+	return map[string]*Bitmap{
+		"empty":       NewBitmap(),
+		"zero":        FromSortedList([]uint64{0}),
+		"arrays":      sparse,
+		"bitmaps":     dense,
+		"runs":        runs,
+		"mixed":       mixed,
+		"alternating": alternating,
+	}
+}
+
+func TestPortable(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	bitmaps := portableTestBitmaps(rnd)
+
+	for name, bm := range bitmaps {
+		t.Run(name, func(t *testing.T) {
+			arr := bm.ToArray()
+			buf := bm.ToPortableBuffer()
+
+			t.Run("round trip", func(t *testing.T) {
+				res, err := FromPortableBuffer(buf)
+				require.NoError(t, err)
+				require.Equal(t, len(arr), res.GetCardinality())
+				require.Equal(t, arr, res.ToArray())
+				require.NoError(t, Validate(res.ToBuffer()))
+
+				// Read bitmap is fully writable.
+				expected := bm.Clone()
+				for _, b := range []*Bitmap{expected, res} {
+					if len(arr) > 0 {
+						b.RemoveRange(arr[len(arr)-1]+1, arr[len(arr)-1]+10)
+					}
+					b.RemoveRange(0, 10)
+					b.RemoveRange(1000, 2000)
+					b.Set(1 << 50)
+				}
+				require.Equal(t, expected.ToArray(), res.ToArray())
+
+				var w bytes.Buffer
+				n, err := bm.WritePortable(&w)
+				require.NoError(t, err)
+				require.Equal(t, int64(len(buf)), n)
+				require.Equal(t, buf, w.Bytes())
+			})
+
+			t.Run("read by roaring64", func(t *testing.T) {
+				rb := roaring64.New()
+				_, err := rb.ReadFrom(bytes.NewReader(buf))
+				require.NoError(t, err)
+				require.Equal(t, uint64(len(arr)), rb.GetCardinality())
+				if len(arr) > 0 {
+					require.Equal(t, arr, rb.ToArray())
+				}
+			})
+
+			t.Run("written by roaring64", func(t *testing.T) {
+				for _, optimize := range []bool{false, true} {
+					rb := roaring64.BitmapOf(arr...)
+					if optimize {
+						rb.RunOptimize()
+					}
+					var w bytes.Buffer
+					_, err := rb.WriteTo(&w)
+					require.NoError(t, err)
+
+					res, err := ReadPortable(&w)
+					require.NoError(t, err)
+					require.Equal(t, len(arr), res.GetCardinality())
+					if len(arr) > 0 {
+						require.Equal(t, arr, res.ToArray())
+					}
+					require.Zero(t, w.Len())
+				}
+			})
+		})
+	}
+
+	t.Run("run containers are kept", func(t *testing.T) {
+		res, err := FromPortableBuffer(bitmaps["runs"].ToPortableBuffer())
+		require.NoError(t, err)
+		var numRuns int
+		for i := 0; i < res.keys.numKeys(); i++ {
+			if res.getContainer(res.keys.val(i))[indexType] == typeRun {
+				numRuns++
+			}
+		}
+		require.Greater(t, numRuns, 0)
+	})
+
+	t.Run("multiple bitmaps in a stream", func(t *testing.T) {
+		var w bytes.Buffer
+		_, err := bitmaps["mixed"].WritePortable(&w)
+		require.NoError(t, err)
+		_, err = bitmaps["zero"].WritePortable(&w)
+		require.NoError(t, err)
+
+		res, err := ReadPortable(&w)
+		require.NoError(t, err)
+		require.Equal(t, bitmaps["mixed"].ToArray(), res.ToArray())
+		res, err = ReadPortable(&w)
+		require.NoError(t, err)
+		require.Equal(t, []uint64{0}, res.ToArray())
+	})
+
+	t.Run("adjacent runs", func(t *testing.T) {
+		buf := binary.LittleEndian.AppendUint64(nil, 1) // numBuckets
+		buf = binary.LittleEndian.AppendUint32(buf, 0)  // key
+		buf = binary.LittleEndian.AppendUint32(buf, portableCookie)
+		buf = append(buf, 1)                           // container 0 is a run container
+		buf = binary.LittleEndian.AppendUint16(buf, 0) // key of the container
+		buf = binary.LittleEndian.AppendUint16(buf, 9) // cardinality - 1
+		buf = binary.LittleEndian.AppendUint16(buf, 2) // numRuns
+		for _, v := range []uint16{0, 4, 5, 4} {
+			buf = binary.LittleEndian.AppendUint16(buf, v)
+		}
+		_, err := FromPortableBuffer(buf)
+		require.ErrorIs(t, err, ErrInvalidBuffer)
+
+		// Runs [0, 4] and [6, 10] are fine.
+		binary.LittleEndian.PutUint16(buf[len(buf)-4:], 6)
+		res, err := FromPortableBuffer(buf)
+		require.NoError(t, err)
+		require.Equal(t, []uint64{0, 1, 2, 3, 4, 6, 7, 8, 9, 10}, res.ToArray())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		buf := bitmaps["mixed"].ToPortableBuffer()
+		for _, n := range []int{0, 3, 8, 11, 12, 20, len(buf) / 2, len(buf) - 1} {
+			_, err := FromPortableBuffer(buf[:n])
+			require.Errorf(t, err, "truncated to %d bytes", n)
+		}
+
+		for i := 0; i < 1000; i++ {
+			corrupted := append([]byte(nil), buf...)
+			for j := rnd.Intn(4); j >= 0; j-- {
+				corrupted[rnd.Intn(len(corrupted))] = byte(rnd.Intn(256))
+			}
+			res, err := FromPortableBuffer(corrupted)
+			if err != nil {
+				continue
+			}
+			// Whatever is read has to be a valid bitmap.
+			require.NoError(t, Validate(res.ToBuffer()))
+		}
+	})
+}
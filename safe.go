@@ -0,0 +1,159 @@
+package sroar
+
+import (
+	"slices"
+	"sync"
+)
+
+// SafeBitmap wraps Bitmap with a lock, so it can be used concurrently. In batching mode, Set
+// only buffers the elements, which are added in sorted order by SetMany once the batch is full,
+// or before any other operation needs them. Bitmap itself is not affected, wrapping it is only
+// worth it for bitmaps used concurrently.
+type SafeBitmap struct {
+	mu sync.RWMutex
+	bm *Bitmap
+
+	// pending are the elements buffered by Set in batching mode, not added to bm yet.
+	// They are swapped out only with mu locked for writing.
+	pendingMu sync.Mutex
+	pending   []uint64
+	batchSize int
+}
+
+// NewSafeBitmap returns a SafeBitmap wrapping bm, or an empty bitmap if bm is nil. The bitmap
+// has to be writable and it must not be used directly anymore.
+func NewSafeBitmap(bm *Bitmap) *SafeBitmap {
+	if bm == nil {
+		bm = NewBitmap()
+	}
+	return &SafeBitmap{bm: bm}
+}
+
+// NewBatchedSafeBitmap returns a SafeBitmap wrapping bm in batching mode, in which Set buffers
+// up to batchSize elements before adding them. Batching is disabled for batchSize <= 1.
+func NewBatchedSafeBitmap(bm *Bitmap, batchSize int) *SafeBitmap {
+	sb := NewSafeBitmap(bm)
+	if batchSize > 1 {
+		sb.batchSize = batchSize
+		sb.pending = make([]uint64, 0, batchSize)
+	}
+	return sb
+}
+
+// Set adds x to the bitmap. In batching mode x is buffered and it is added later, though it is
+// visible to all the other methods right away.
+func (sb *SafeBitmap) Set(x uint64) {
+	if sb.batchSize == 0 {
+		sb.mu.Lock()
+		sb.bm.Set(x)
+		sb.mu.Unlock()
+		return
+	}
+
+	sb.pendingMu.Lock()
+	sb.pending = append(sb.pending, x)
+	full := len(sb.pending) >= sb.batchSize
+	sb.pendingMu.Unlock()
+	if full {
+		sb.Flush()
+	}
+}
+
+// SetMany adds all the values to the bitmap. Values are sorted first, the given slice is not
+// modified.
+func (sb *SafeBitmap) SetMany(vals []uint64) {
+	sorted := slices.Clone(vals)
+	slices.Sort(sorted)
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.flush()
+	sb.bm.SetMany(sorted)
+}
+
+// Flush adds the elements buffered by Set in batching mode.
+func (sb *SafeBitmap) Flush() {
+	if !sb.hasPending() {
+		return
+	}
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.flush()
+}
+
+func (sb *SafeBitmap) hasPending() bool {
+	if sb.batchSize == 0 {
+		return false
+	}
+	sb.pendingMu.Lock()
+	defer sb.pendingMu.Unlock()
+	return len(sb.pending) > 0
+}
+
+// flush adds the buffered elements. mu has to be locked for writing.
+func (sb *SafeBitmap) flush() {
+	if sb.batchSize == 0 {
+		return
+	}
+	sb.pendingMu.Lock()
+	batch := sb.pending
+	sb.pending = make([]uint64, 0, sb.batchSize)
+	sb.pendingMu.Unlock()
+
+	slices.Sort(batch)
+	sb.bm.SetMany(batch)
+}
+
+// Remove removes x from the bitmap. It returns true if x was in the bitmap before.
+func (sb *SafeBitmap) Remove(x uint64) bool {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.flush()
+	return sb.bm.Remove(x)
+}
+
+func (sb *SafeBitmap) Contains(x uint64) bool {
+	sb.mu.RLock()
+	defer sb.mu.RUnlock()
+	if sb.bm.Contains(x) {
+		return true
+	}
+	if sb.batchSize == 0 {
+		return false
+	}
+	// Buffered elements can not be flushed while mu is locked for reading.
+	sb.pendingMu.Lock()
+	defer sb.pendingMu.Unlock()
+	return slices.Contains(sb.pending, x)
+}
+
+func (sb *SafeBitmap) GetCardinality() int {
+	sb.Flush()
+	sb.mu.RLock()
+	defer sb.mu.RUnlock()
+	return sb.bm.GetCardinality()
+}
+
+// Or adds all the elements of bm to the bitmap. bm must not be modified concurrently.
+func (sb *SafeBitmap) Or(bm *Bitmap) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.flush()
+	sb.bm.Or(bm)
+}
+
+// And removes all the elements not in bm from the bitmap. bm must not be modified concurrently.
+func (sb *SafeBitmap) And(bm *Bitmap) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.flush()
+	sb.bm.And(bm)
+}
+
+// Clone returns a copy of the bitmap, which can be used without any locking.
+func (sb *SafeBitmap) Clone() *Bitmap {
+	sb.Flush()
+	sb.mu.RLock()
+	defer sb.mu.RUnlock()
+	return sb.bm.Clone()
+}
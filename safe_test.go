@@ -0,0 +1,104 @@
+package sroar
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSafeBitmap(t *testing.T) {
+	for name, newSafe := range map[string]func() *SafeBitmap{
+		"locked":  func() *SafeBitmap { return NewSafeBitmap(nil) },
+		"batched": func() *SafeBitmap { return NewBatchedSafeBitmap(nil, 64) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Run("matches bitmap", func(t *testing.T) {
+				rnd := rand.New(rand.NewSource(1))
+				sb := newSafe()
+				bm := NewBitmap()
+				for i := 0; i < 50_000; i++ {
+					x := rnd.Uint64() % (30 << 16)
+					switch i % 5 {
+					case 0:
+						require.Equal(t, bm.Remove(x), sb.Remove(x))
+					case 1:
+						require.Equal(t, bm.Contains(x), sb.Contains(x))
+					default:
+						bm.Set(x)
+						sb.Set(x)
+						require.True(t, sb.Contains(x))
+					}
+				}
+				require.Equal(t, bm.GetCardinality(), sb.GetCardinality())
+
+				vals := []uint64{1 << 40, 5, 3 << 20, 7}
+				bm.SetMany(vals)
+				sb.SetMany(vals)
+				require.Equal(t, []uint64{1 << 40, 5, 3 << 20, 7}, vals)
+
+				other := NewBitmap()
+				for i := 0; i < 10_000; i++ {
+					other.Set(rnd.Uint64() % (40 << 16))
+				}
+				bm.Or(other)
+				sb.Or(other)
+				require.Equal(t, bm.ToArray(), sb.Clone().ToArray())
+
+				other.Set(1 << 40)
+				bm.And(other)
+				sb.Set(100)
+				sb.And(other)
+				require.Equal(t, bm.ToArray(), sb.Clone().ToArray())
+			})
+
+			t.Run("concurrent use", func(t *testing.T) {
+				sb := newSafe()
+				expected := NewBitmap()
+				var wg sync.WaitGroup
+				for g := 0; g < 8; g++ {
+					rnd := rand.New(rand.NewSource(int64(g)))
+					vals := make([]uint64, 5000)
+					for i := range vals {
+						vals[i] = rnd.Uint64() % (20 << 16)
+						expected.Set(vals[i])
+					}
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i, x := range vals {
+							sb.Set(x)
+							require.True(t, sb.Contains(x))
+							if i%100 == 0 {
+								sb.GetCardinality()
+							}
+						}
+					}()
+				}
+				wg.Wait()
+				require.Equal(t, expected.GetCardinality(), sb.GetCardinality())
+				require.True(t, expected.Equals(sb.Clone()))
+			})
+		})
+	}
+
+	t.Run("flush", func(t *testing.T) {
+		sb := NewBatchedSafeBitmap(nil, 100)
+		for x := uint64(10); x > 0; x-- {
+			sb.Set(x)
+		}
+		require.Len(t, sb.pending, 10)
+		require.True(t, sb.bm.IsEmpty())
+		sb.Flush()
+		require.Empty(t, sb.pending)
+		require.Equal(t, []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, sb.bm.ToArray())
+
+		// Batch is added once it is full.
+		for x := uint64(0); x < 100; x++ {
+			sb.Set(x << 16)
+		}
+		require.Empty(t, sb.pending)
+		require.Equal(t, 110, sb.bm.GetCardinality())
+	})
+}
@@ -0,0 +1,240 @@
+package sroar
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Framed format wraps the buffer returned by ToBuffer with a header describing it:
+//
+//	magic   [4]byte  "SRBM"
+//	version uint16   framedVersion
+//	flags   uint16   flagBigEndian if payload was written on a big endian machine
+//	length  uint64   length of the payload in bytes
+//	crc     uint32   CRC32C (Castagnoli) of the payload
+//	_       uint32   reserved, keeps the payload 8 bytes aligned
+//	payload [length]byte
+//
+// Header fields are always little endian. Payload is kept in the native byte order, so it can be
+// used by FromBuffer without copying.
+const (
+	framedHeaderSize = 24
+	framedVersion    = 1
+
+	flagBigEndian = 1 << 0
+)
+
+var framedMagic = [4]byte{'S', 'R', 'B', 'M'}
+
+var (
+	_ io.WriterTo                = (*Bitmap)(nil)
+	_ io.ReaderFrom              = (*Bitmap)(nil)
+	_ encoding.BinaryMarshaler   = (*Bitmap)(nil)
+	_ encoding.BinaryUnmarshaler = (*Bitmap)(nil)
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrChecksumMismatch is returned when the checksum of the framed payload does not match.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+func nativeFlags() uint16 {
+	if binary.NativeEndian.Uint16([]byte{0, 1}) == 1 {
+		return flagBigEndian
+	}
+	return 0
+}
+
+func framedHeader(payload []byte) [framedHeaderSize]byte {
+	var hdr [framedHeaderSize]byte
+	copy(hdr[0:4], framedMagic[:])
+	binary.LittleEndian.PutUint16(hdr[4:6], framedVersion)
+	binary.LittleEndian.PutUint16(hdr[6:8], nativeFlags())
+	binary.LittleEndian.PutUint64(hdr[8:16], uint64(len(payload)))
+	binary.LittleEndian.PutUint32(hdr[16:20], crc32.Checksum(payload, crc32cTable))
+	return hdr
+}
+
+// parseFramedHeader verifies the header and returns the length of the payload and its checksum.
+func parseFramedHeader(hdr []byte) (uint64, uint32, error) {
+	if len(hdr) < framedHeaderSize {
+		return 0, 0, errors.Wrapf(ErrInvalidBuffer, "framed header too short: %d bytes", len(hdr))
+	}
+	if [4]byte(hdr[0:4]) != framedMagic {
+		return 0, 0, errors.Wrapf(ErrInvalidBuffer, "invalid magic %q", hdr[0:4])
+	}
+	if version := binary.LittleEndian.Uint16(hdr[4:6]); version != framedVersion {
+		return 0, 0, errors.Wrapf(ErrInvalidBuffer, "unsupported version %d", version)
+	}
+	if flags := binary.LittleEndian.Uint16(hdr[6:8]); flags != nativeFlags() {
+		return 0, 0, errors.Wrapf(ErrInvalidBuffer, "unsupported flags %#x, byte order differs", flags)
+	}
+	length := binary.LittleEndian.Uint64(hdr[8:16])
+	if length%2 != 0 {
+		return 0, 0, errors.Wrapf(ErrInvalidBuffer, "odd payload length %d", length)
+	}
+	return length, binary.LittleEndian.Uint32(hdr[16:20]), nil
+}
+
+// ToBufferFramed returns a copy of the bitmap's buffer preceded by a header holding format
+// version, byte order, length and checksum of the buffer. Use FromBufferFramed or ReadFramed to
+// read it back.
+func (ra *Bitmap) ToBufferFramed() []byte {
+	payload := ra.ToBuffer()
+	hdr := framedHeader(payload)
+	buf := make([]byte, framedHeaderSize+len(payload))
+	copy(buf, hdr[:])
+	copy(buf[framedHeaderSize:], payload)
+	return buf
+}
+
+// WriteTo writes the bitmap in the framed format to w. It implements io.WriterTo.
+func (ra *Bitmap) WriteTo(w io.Writer) (int64, error) {
+	payload := ra.ToBuffer()
+	hdr := framedHeader(payload)
+	n, err := w.Write(hdr[:])
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := w.Write(payload)
+	return int64(n + m), err
+}
+
+// FromBufferFramed verifies the header and the checksum of the framed buffer, validates its
+// payload and returns a pointer to bitmap corresponding to it. Just like with FromBuffer, the
+// payload is not copied and the bitmap is read-only.
+func FromBufferFramed(buf []byte) (*Bitmap, error) {
+	length, crc, err := parseFramedHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(buf)-framedHeaderSize) < length {
+		return nil, errors.Wrapf(ErrInvalidBuffer, "payload truncated: %d of %d bytes",
+			len(buf)-framedHeaderSize, length)
+	}
+	payload := buf[framedHeaderSize : framedHeaderSize+length]
+	if actual := crc32.Checksum(payload, crc32cTable); actual != crc {
+		return nil, errors.Wrapf(ErrChecksumMismatch, "expected %#x, got %#x", crc, actual)
+	}
+	if err := Validate(payload); err != nil {
+		return nil, err
+	}
+	return FromBuffer(payload), nil
+}
+
+// ReadFramed reads a bitmap in the framed format from r. The payload is validated, the bitmap is
+// safe for both read and write operations.
+func ReadFramed(r io.Reader) (*Bitmap, error) {
+	bm, _, err := readFramed(r)
+	return bm, err
+}
+
+// ReadFrom reads a bitmap in the framed format from r, replacing the contents of the bitmap.
+// The payload is validated, the contents are kept if it is not valid. Buffer of a thawed bitmap
+// is not copied, it is just dropped, and the file backing a bitmap returned by OpenMapped is
+// unmapped once the new contents are in place. It implements io.ReaderFrom.
+func (ra *Bitmap) ReadFrom(r io.Reader) (int64, error) {
+	if ra.readOnly {
+		panic(ErrReadOnly)
+	}
+	bm, n, err := readFramed(r)
+	if err != nil {
+		return n, err
+	}
+	ra.data = bm.data
+	ra.keys = bm.keys
+	ra._ptr = nil
+	ra.memMoved = 0
+	ra.copyOnWrite = false
+	ra.invalidateRankIndex()
+	if mapping := ra.mapping; mapping != nil {
+		ra.mapping = nil
+		return n, munmap(mapping)
+	}
+	return n, nil
+}
+
+// MarshalBinary returns the bitmap in the framed format. It implements
+// encoding.BinaryMarshaler, which is also used by gob.
+func (ra *Bitmap) MarshalBinary() ([]byte, error) {
+	return ra.ToBufferFramed(), nil
+}
+
+// UnmarshalBinary replaces the contents of the bitmap with the framed bitmap. Data is copied,
+// so it is not referenced by the bitmap. It implements encoding.BinaryUnmarshaler, which is
+// also used by gob.
+func (ra *Bitmap) UnmarshalBinary(data []byte) error {
+	_, err := ra.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+// readFramed reads a bitmap in the framed format from r. It returns the number of bytes read.
+func readFramed(r io.Reader) (*Bitmap, int64, error) {
+	var hdr [framedHeaderSize]byte
+	n, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, int64(n), errors.Wrap(err, "reading framed header")
+	}
+	length, crc, err := parseFramedHeader(hdr[:])
+	if err != nil {
+		return nil, int64(n), err
+	}
+	if length == 0 {
+		return NewBitmap(), int64(n), nil
+	}
+
+	data, m, err := readUint16s(r, length/2)
+	if err != nil {
+		return nil, int64(n + m), errors.Wrap(err, "reading framed payload")
+	}
+	read := int64(n + m)
+	if actual := crc32.Checksum(toByteSlice(data), crc32cTable); actual != crc {
+		return nil, read, errors.Wrapf(ErrChecksumMismatch, "expected %#x, got %#x", crc, actual)
+	}
+	// The checksum only guards against corruption in transit, the payload itself has to be
+	// validated before it is used.
+	if err := Validate(toByteSlice(data)); err != nil {
+		return nil, read, errors.Wrap(err, "framed payload")
+	}
+	x := toUint64Slice(data[:4])[indexNodeSize]
+	return &Bitmap{
+		data: data,
+		keys: toUint64Slice(data[:x]),
+	}, read, nil
+}
+
+// readUint16s reads n uint16s from r directly into a []uint16. As n usually comes from
+// the input itself, memory is allocated as the data arrives rather than upfront.
+func readUint16s(r io.Reader, n uint64) ([]uint16, int, error) {
+	const initialChunk = 1 << 20
+	// Length in bytes has to fit an int.
+	if n > math.MaxInt/2 {
+		return nil, 0, errors.Wrapf(ErrInvalidBuffer, "length %d too large", n)
+	}
+	size := int(n)
+	data := make([]uint16, 0, min(size, initialChunk))
+	var read int
+	for len(data) < size {
+		if len(data) == cap(data) {
+			grown := make([]uint16, len(data), min(size, 2*cap(data)))
+			copy(grown, data)
+			data = grown
+		}
+		m, err := io.ReadFull(r, toByteSlice(data[len(data):cap(data)]))
+		read += m
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, read, err
+		}
+		data = data[:cap(data)]
+	}
+	return data, read, nil
+}
@@ -0,0 +1,261 @@
+package sroar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFramed(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	bm := NewBitmap()
+	for i := 0; i < 50_000; i++ {
+		bm.Set(rnd.Uint64() % (20 << 16))
+	}
+	bm.Or(toRunBitmap(runsBitmap(rnd, 50, 5000, 40<<16)))
+
+	t.Run("round trip", func(t *testing.T) {
+		for _, src := range []*Bitmap{bm, NewBitmap(), FromSortedList([]uint64{0})} {
+			buf := src.ToBufferFramed()
+			require.Equal(t, framedHeaderSize+len(src.ToBuffer()), len(buf))
+
+			res, err := FromBufferFramed(buf)
+			require.NoError(t, err)
+			require.Equal(t, src.ToArray(), res.ToArray())
+
+			var w bytes.Buffer
+			n, err := src.WriteTo(&w)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(buf)), n)
+			require.Equal(t, buf, w.Bytes())
+
+			res, err = ReadFramed(&w)
+			require.NoError(t, err)
+			require.Equal(t, src.ToArray(), res.ToArray())
+		}
+	})
+
+	t.Run("read bitmap is writable", func(t *testing.T) {
+		buf := bm.ToBufferFramed()
+		res, err := ReadFramed(bytes.NewReader(buf))
+		require.NoError(t, err)
+		res.Set(100 << 16)
+		res.Remove(bm.Minimum())
+		require.Equal(t, bm.GetCardinality(), res.GetCardinality())
+
+		// Source buffer is not affected.
+		src, err := FromBufferFramed(buf)
+		require.NoError(t, err)
+		require.Equal(t, bm.ToArray(), src.ToArray())
+	})
+
+	t.Run("multiple bitmaps in a stream", func(t *testing.T) {
+		var w bytes.Buffer
+		other := FromSortedList([]uint64{1, 2, 3})
+		_, err := bm.WriteTo(&w)
+		require.NoError(t, err)
+		_, err = other.WriteTo(&w)
+		require.NoError(t, err)
+
+		res, err := ReadFramed(&w)
+		require.NoError(t, err)
+		require.Equal(t, bm.ToArray(), res.ToArray())
+		res, err = ReadFramed(&w)
+		require.NoError(t, err)
+		require.Equal(t, other.ToArray(), res.ToArray())
+		_, err = ReadFramed(&w)
+		require.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		corrupt := func(modify func(buf []byte) []byte) []byte {
+			return modify(bm.ToBufferFramed())
+		}
+		invalid := map[string]struct {
+			buf []byte
+			err error
+		}{
+			"magic": {corrupt(func(buf []byte) []byte {
+				buf[0] = 'X'
+				return buf
+			}), ErrInvalidBuffer},
+			"version": {corrupt(func(buf []byte) []byte {
+				binary.LittleEndian.PutUint16(buf[4:6], framedVersion+1)
+				return buf
+			}), ErrInvalidBuffer},
+			"byte order": {corrupt(func(buf []byte) []byte {
+				binary.LittleEndian.PutUint16(buf[6:8], nativeFlags()^flagBigEndian)
+				return buf
+			}), ErrInvalidBuffer},
+			"odd length": {corrupt(func(buf []byte) []byte {
+				binary.LittleEndian.PutUint64(buf[8:16], uint64(len(buf)-framedHeaderSize-1))
+				return buf
+			}), ErrInvalidBuffer},
+			"payload": {corrupt(func(buf []byte) []byte {
+				buf[framedHeaderSize+len(buf)/2] ^= 0x10
+				return buf
+			}), ErrChecksumMismatch},
+			"checksum": {corrupt(func(buf []byte) []byte {
+				buf[16]++
+				return buf
+			}), ErrChecksumMismatch},
+			"header": {corrupt(func(buf []byte) []byte {
+				return buf[:framedHeaderSize-1]
+			}), nil},
+			"truncated": {corrupt(func(buf []byte) []byte {
+				return buf[:len(buf)-2]
+			}), nil},
+			"huge length": {corrupt(func(buf []byte) []byte {
+				binary.LittleEndian.PutUint64(buf[8:16], 1<<62)
+				return buf
+			}), nil},
+		}
+		for name, tc := range invalid {
+			t.Run(name, func(t *testing.T) {
+				_, err := FromBufferFramed(tc.buf)
+				require.Error(t, err)
+				if tc.err != nil {
+					require.ErrorIs(t, err, tc.err)
+				}
+				_, err = ReadFramed(bytes.NewReader(tc.buf))
+				require.Error(t, err)
+				if tc.err != nil {
+					require.ErrorIs(t, err, tc.err)
+				}
+			})
+		}
+	})
+}
+
+func TestSerializationInterfaces(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	bm := NewBitmap()
+	for i := 0; i < 50_000; i++ {
+		bm.Set(rnd.Uint64() % (20 << 16))
+	}
+	bm.Or(toRunBitmap(runsBitmap(rnd, 50, 5000, 40<<16)))
+	// Large enough for the payload to be read in multiple chunks.
+	large := Prefill(300 << 16)
+	large.Set(1 << 40)
+
+	for name, src := range map[string]*Bitmap{"mixed": bm, "large": large, "empty": NewBitmap()} {
+		t.Run(name, func(t *testing.T) {
+			t.Run("reader from", func(t *testing.T) {
+				var w bytes.Buffer
+				written, err := src.WriteTo(&w)
+				require.NoError(t, err)
+
+				res := FromSortedList([]uint64{1, 2, 3})
+				res.Rank(2)
+				read, err := res.ReadFrom(&w)
+				require.NoError(t, err)
+				require.Equal(t, written, read)
+				require.Equal(t, src.GetCardinality(), res.GetCardinality())
+				require.True(t, src.Equals(res))
+				if src.GetCardinality() > 0 {
+					x := src.Maximum()
+					require.Equal(t, src.GetCardinality()-1, res.Rank(x))
+				}
+
+				// Read bitmap owns its data.
+				res.Set(1 << 50)
+				require.False(t, src.Contains(1<<50))
+			})
+
+			t.Run("binary marshaler", func(t *testing.T) {
+				data, err := src.MarshalBinary()
+				require.NoError(t, err)
+
+				res := NewBitmap()
+				require.NoError(t, res.UnmarshalBinary(data))
+				require.True(t, src.Equals(res))
+
+				// Data is not referenced by the bitmap.
+				for i := range data {
+					data[i] = 0
+				}
+				require.True(t, src.Equals(res))
+			})
+
+			t.Run("gob", func(t *testing.T) {
+				type record struct {
+					Name   string
+					Bitmap *Bitmap
+				}
+				var w bytes.Buffer
+				require.NoError(t, gob.NewEncoder(&w).Encode(record{Name: name, Bitmap: src}))
+
+				var res record
+				require.NoError(t, gob.NewDecoder(&w).Decode(&res))
+				require.Equal(t, name, res.Name)
+				require.True(t, src.Equals(res.Bitmap))
+			})
+		})
+	}
+
+	t.Run("failed read keeps contents", func(t *testing.T) {
+		res := FromSortedList([]uint64{1, 2, 3})
+		buf := bm.ToBufferFramed()
+		_, err := res.ReadFrom(bytes.NewReader(buf[:len(buf)/2]))
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		require.Equal(t, []uint64{1, 2, 3}, res.ToArray())
+
+		require.Error(t, res.UnmarshalBinary([]byte("garbage")))
+		require.Equal(t, []uint64{1, 2, 3}, res.ToArray())
+	})
+
+	t.Run("read into thawed bitmap", func(t *testing.T) {
+		buf := FromSortedList([]uint64{1, 2, 3}).ToBufferWithCopy()
+		orig := append([]byte(nil), buf...)
+		res := FromBuffer(buf)
+		require.PanicsWithValue(t, ErrReadOnly, func() { res.ReadFrom(bytes.NewReader(bm.ToBufferFramed())) })
+
+		res.Thaw()
+		require.Equal(t, 1, res.Rank(2))
+		_, err := res.ReadFrom(bytes.NewReader(bm.ToBufferFramed()))
+		require.NoError(t, err)
+		require.False(t, res.copyOnWrite)
+		require.True(t, bm.Equals(res))
+		require.Equal(t, bm.Rank(bm.Maximum()), res.Rank(bm.Maximum()))
+
+		res.Set(1 << 50)
+		res.Remove(bm.Minimum())
+		require.Equal(t, orig, buf)
+	})
+
+	t.Run("invalid payload with valid checksum", func(t *testing.T) {
+		frame := func(payload []byte) []byte {
+			hdr := framedHeader(payload)
+			return append(hdr[:], payload...)
+		}
+		corrupted := map[string]func(b *Bitmap){
+			"first key": func(b *Bitmap) { b.keys.setAt(keyOffset(0), 1<<16) },
+			"offset":    func(b *Bitmap) { b.keys.setAt(valOffset(1), uint64(len(b.data))) },
+			"num keys":  func(b *Bitmap) { b.keys.setNumKeys(b.keys.maxKeys()) },
+			"array order": func(b *Bitmap) {
+				c := b.getContainer(b.keys.val(b.keys.numKeys() - 1))
+				c[startIdx], c[startIdx+1] = c[startIdx+1], c[startIdx]
+			},
+		}
+		for name, corrupt := range corrupted {
+			b := FromSortedList([]uint64{1, 2, 3, 5 << 16, 5<<16 + 1})
+			corrupt(b)
+			buf := frame(toByteSlice(b.data))
+
+			res := FromSortedList([]uint64{1, 2, 3})
+			_, err := res.ReadFrom(bytes.NewReader(buf))
+			require.ErrorIsf(t, err, ErrInvalidBuffer, "corruption %s", name)
+			require.Equal(t, []uint64{1, 2, 3}, res.ToArray())
+			require.ErrorIs(t, res.UnmarshalBinary(buf), ErrInvalidBuffer)
+			_, err = ReadFramed(bytes.NewReader(buf))
+			require.ErrorIs(t, err, ErrInvalidBuffer)
+			_, err = FromBufferFramed(buf)
+			require.ErrorIs(t, err, ErrInvalidBuffer)
+		}
+	})
+}
@@ -83,12 +83,14 @@ func toUint64Slice(b []uint16) []uint64 {
 //go:linkname memclrNoHeapPointers runtime.memclrNoHeapPointers
 func memclrNoHeapPointers(p unsafe.Pointer, n uintptr)
 
+// Memclr zeroes out the given slice.
 func Memclr(b []uint16) {
 	if len(b) == 0 {
 		return
 	}
 	p := unsafe.Pointer(&b[0])
-	memclrNoHeapPointers(p, uintptr(len(b)))
+	// Length is given in bytes, each uint16 takes 2 of them.
+	memclrNoHeapPointers(p, uintptr(2*len(b)))
 }
 
 // Following methods do not make copies, they are pointer-based (unsafe).